@@ -0,0 +1,102 @@
+// Package artifact moves files from the guest to the host with a raw virtual disk.
+//
+// If enabled with SetArtifacts of github.com/florianl/bluebox/initramfs, bluebox-init writes the
+// files of a directory in the guest as tar stream to a block device, once all executables
+// finished. The disk image that backs the block device is created with CreateDisk before the
+// virtual machine is started and unpacked with Extract after it stopped. As the tar stream is
+// written directly to the block device, the kernel of the guest needs no file system driver for it.
+package artifact
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultSize is the size of a disk created by CreateDisk, if no size is given.
+const DefaultSize = 256 << 20
+
+// CreateDisk creates the raw disk image file with size bytes. The file is sparse on file systems
+// that support it, so only the written artifacts take up space. An existing file is truncated.
+func CreateDisk(file string, size int64) error {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return fmt.Errorf("failed to create disk: %v", err)
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to resize disk: %v", err)
+	}
+	return f.Close()
+}
+
+// Extract unpacks the tar stream, that bluebox-init wrote to the disk r, into dir and returns the
+// names of the extracted files. Only regular files and directories are extracted and entries, that
+// would end up outside of dir, are rejected. A disk, that holds no artifacts, is not an error.
+func Extract(r io.Reader, dir string) ([]string, error) {
+	var files []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		}
+		if err != nil {
+			return files, fmt.Errorf("failed to read artifacts: %v", err)
+		}
+
+		name := path.Clean(strings.TrimSuffix(hdr.Name, "/"))
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			return files, fmt.Errorf("invalid artifact name %s", hdr.Name)
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, 0o755); err != nil {
+				return files, err
+			}
+		case tar.TypeReg:
+			if err := extractFile(tr, dst, hdr.FileInfo().Mode().Perm()); err != nil {
+				return files, fmt.Errorf("failed to extract %s: %v", name, err)
+			}
+			files = append(files, name)
+		default:
+			return files, fmt.Errorf("unsupported type %q of artifact %s", hdr.Typeflag, name)
+		}
+	}
+}
+
+// ExtractFile unpacks the tar stream of the disk image file into dir. See Extract.
+func ExtractFile(file, dir string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Extract(f, dir)
+}
+
+// extractFile writes the content of r to the file dst with the permission bits perm.
+func extractFile(r io.Reader, dst string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm|0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,104 @@
+package artifact
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeDisk creates a disk image like bluebox-init does, with the tar stream of entries followed
+// by unused space.
+func writeDisk(t *testing.T, entries []*tar.Header, content map[string]string) string {
+	t.Helper()
+	disk := filepath.Join(t.TempDir(), "artifacts.img")
+	if err := CreateDisk(disk, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(disk, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for _, hdr := range entries {
+		hdr.Size = int64(len(content[hdr.Name]))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content[hdr.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return disk
+}
+
+func TestExtract(t *testing.T) {
+	disk := writeDisk(t, []*tar.Header{
+		{Name: "junit/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "junit/report.xml", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "cpu.pprof", Typeflag: tar.TypeReg, Mode: 0o600},
+	}, map[string]string{
+		"junit/report.xml": "<testsuites/>",
+		"cpu.pprof":        "profile",
+	})
+
+	info, err := os.Stat(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 1<<20 {
+		t.Fatalf("expected disk of 1 MiB but got %d bytes", info.Size())
+	}
+
+	dir := t.TempDir()
+	files, err := ExtractFile(disk, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"junit/report.xml", "cpu.pprof"}; !reflect.DeepEqual(files, expected) {
+		t.Fatalf("expected %q but got %q", expected, files)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "junit", "report.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "<testsuites/>" {
+		t.Fatalf("unexpected content %q", data)
+	}
+}
+
+func TestExtractEmpty(t *testing.T) {
+	disk := filepath.Join(t.TempDir(), "artifacts.img")
+	if err := CreateDisk(disk, 0); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ExtractFile(disk, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("expected no files but got %q", files)
+	}
+}
+
+func TestExtractInvalid(t *testing.T) {
+	tests := map[string]*tar.Header{
+		"parent":   {Name: "../escape", Typeflag: tar.TypeReg, Mode: 0o644},
+		"absolute": {Name: "/etc/passwd", Typeflag: tar.TypeReg, Mode: 0o644},
+		"symlink":  {Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+	}
+	for name, hdr := range tests {
+		t.Run(name, func(t *testing.T) {
+			disk := writeDisk(t, []*tar.Header{hdr}, nil)
+			if _, err := ExtractFile(disk, t.TempDir()); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
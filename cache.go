@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/florianl/bluebox/initramfs"
+)
+
+// cacheCommand inspects and prunes the build cache of the init programs.
+func cacheCommand(args []string) error {
+	var dir string
+	var maxAge time.Duration
+
+	fs := flag.NewFlagSet("cache", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "cache inspects the build cache of the init programs.\n\n"+
+			"Commands:\n  dir\t\tPrint the directory of the build cache.\n"+
+			"  list\t\tList the cached init programs. This is the default.\n"+
+			"  prune\t\tRemove cached init programs, that were not used within -age.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&dir, "dir", "", "Directory of the build cache. By default the directory "+
+		"bluebox inside the user cache directory is used.")
+	fs.DurationVar(&maxAge, "age", 0, "Remove only cached init programs, that were not used "+
+		"within the given duration, e.g. 720h.\nBy default all of them are removed.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if dir == "" {
+		var err error
+		if dir, err = initramfs.DefaultCacheDir(); err != nil {
+			return err
+		}
+	}
+
+	switch fs.Arg(0) {
+	case "dir":
+		fmt.Println(dir)
+	case "", "list":
+		entries, err := initramfs.ListCache(dir)
+		if err != nil {
+			return err
+		}
+		var total int64
+		for _, e := range entries {
+			fmt.Printf("%s\t%d\t%s\n", e.Key, e.Size, e.LastUsed.Format(time.RFC3339))
+			total += e.Size
+		}
+		fmt.Fprintf(os.Stderr, "%d entries, %d bytes in %s\n", len(entries), total, dir)
+	case "prune":
+		removed, err := initramfs.PruneCache(dir, maxAge)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Removed %d entries from %s\n", len(removed), dir)
+	default:
+		return fmt.Errorf("unknown cache command '%s'", fs.Arg(0))
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/florianl/bluebox/initramfs"
+)
+
+// diffCommand compares two archives.
+func diffCommand(args []string) error {
+	var asJSON bool
+
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "diff compares two initramfs archives entry by entry and the "+
+			"configuration of their init programs.\nIt exits with 1, if the archives differ.\n\n"+
+			"Usage:\n  diff [flags] old-archive new-archive\n\n"+
+			"Use - for one of the archives to read it from stdin.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&asJSON, "json", false, "Write the differences as JSON.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("expected two archives but got %d", fs.NArg())
+	}
+	if fs.Arg(0) == "-" && fs.Arg(1) == "-" {
+		return errors.New("only one archive can be read from stdin")
+	}
+
+	var archives [2]io.Reader
+	for i, name := range fs.Args() {
+		if name == "-" {
+			archives[i] = os.Stdin
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		archives[i] = f
+	}
+
+	d, err := initramfs.Compare(archives[0], archives[1])
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(d); err != nil {
+			return err
+		}
+	} else {
+		printDiff(d)
+	}
+	if !d.Empty() {
+		return exitCode(1)
+	}
+	return nil
+}
+
+// printDiff writes the differences in a human readable form to stdout.
+func printDiff(d initramfs.Diff) {
+	for _, e := range d.Entries {
+		switch e.Change {
+		case initramfs.Added:
+			fmt.Printf("+ %s\n", e.Name)
+		case initramfs.Removed:
+			fmt.Printf("- %s\n", e.Name)
+		default:
+			fmt.Printf("~ %s\n", e.Name)
+			printFields(e.Fields)
+		}
+	}
+	if len(d.Config) > 0 {
+		fmt.Printf("~ %s configuration\n", initramfs.ConfigFile)
+		printFields(d.Config)
+	}
+}
+
+// printFields writes the differing values of fields.
+func printFields(fields []initramfs.FieldDiff) {
+	for _, f := range fields {
+		fmt.Printf("\t%s: %s -> %s\n", f.Field, noneIfEmpty(f.Old), noneIfEmpty(f.New))
+	}
+}
+
+// noneIfEmpty returns s or a placeholder, if s is empty.
+func noneIfEmpty(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
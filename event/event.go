@@ -0,0 +1,347 @@
+// Package event decodes the structured output of bluebox-init.
+//
+// If enabled with SetEventStream of github.com/florianl/bluebox/initramfs, bluebox-init writes
+// every event as a single line to the console. Such a line starts with the marker "@bluebox", the
+// CRC32 (IEEE) of the JSON encoded event as 8 hexadecimal digits and the JSON encoded event
+// itself, separated by single spaces. Other lines, like output of the kernel or of the
+// executables, are ignored. Events that were mixed up with other output are detected by their
+// checksum.
+package event
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// marker starts a line that holds an event.
+const marker = "@bluebox "
+
+// ErrChecksum is returned if the checksum of an event does not match its content.
+var ErrChecksum = errors.New("event: checksum mismatch")
+
+// Type describes the kind of an event.
+type Type string
+
+const (
+	// StepStarted is emitted before an executable is started.
+	StepStarted Type = "step-started"
+	// StdoutLine holds a line an executable wrote to stdout.
+	StdoutLine Type = "stdout-line"
+	// StderrLine holds a line an executable wrote to stderr.
+	StderrLine Type = "stderr-line"
+	// StepExited is emitted once an executable exited and all of its output was emitted.
+	StepExited Type = "step-exited"
+	// StepSkipped is emitted for an executable, that is not run, because the deadline expired or
+	// an earlier executable timed out.
+	StepSkipped Type = "step-skipped"
+	// Shutdown is emitted after all executables were run.
+	Shutdown Type = "shutdown"
+	// File holds a chunk of a file, e.g. coverage data, that is sent to the host.
+	File Type = "file"
+)
+
+// Rusage holds the resources used by an executable.
+type Rusage struct {
+	// UserTime is the time spent in user mode in microseconds.
+	UserTime int64 `json:"utime_us"`
+	// SystemTime is the time spent in kernel mode in microseconds.
+	SystemTime int64 `json:"stime_us"`
+	// MaxRSS is the maximum resident set size in kilobytes.
+	MaxRSS int64 `json:"maxrss_kb"`
+}
+
+// Event is a single entry of the structured output of bluebox-init.
+type Event struct {
+	// Seq is the sequence number of the event, starting at 1.
+	Seq int `json:"seq"`
+	// Type describes the kind of the event.
+	Type Type `json:"type"`
+	// Time is the time in the guest when the event was emitted in nanoseconds since the Unix
+	// epoch.
+	Time int64 `json:"time_ns"`
+	// Step is the number of the executable, starting at 1, the event belongs to.
+	Step int `json:"step,omitempty"`
+	// Name is the path of the executable inside the archive. For Shutdown it holds the
+	// action, that is taken.
+	Name string `json:"name,omitempty"`
+	// Args holds the arguments of the executable for StepStarted.
+	Args []string `json:"args,omitempty"`
+	// Line holds the output for StdoutLine and StderrLine.
+	Line string `json:"line,omitempty"`
+	// Status is the exit status for StepExited. It is -1 if the executable was terminated
+	// by a signal or could not be run.
+	Status *int `json:"status,omitempty"`
+	// Signal is the signal that terminated the executable.
+	Signal string `json:"signal,omitempty"`
+	// Error describes why the executable could not be run.
+	Error string `json:"error,omitempty"`
+	// Duration is the run time of the executable in nanoseconds.
+	Duration int64 `json:"duration_ns,omitempty"`
+	// Rusage holds the resources used by the executable.
+	Rusage *Rusage `json:"rusage,omitempty"`
+	// Exit is the aggregated result of all executables for Shutdown.
+	Exit *int `json:"exit,omitempty"`
+	// TimedOut reports whether the executable was terminated, because its timeout expired.
+	TimedOut bool `json:"timed_out,omitempty"`
+	// Data holds the base64 encoded chunk of the file Name for File.
+	Data string `json:"data,omitempty"`
+	// Offset is the position of the chunk in the file for File.
+	Offset int64 `json:"offset,omitempty"`
+	// Size is the size of the whole file for File.
+	Size int64 `json:"size,omitempty"`
+}
+
+// Parse decodes the event from a single line of console output. It returns false, if line does
+// not start with the marker of an event.
+func Parse(line string) (Event, bool, error) {
+	frame, ok := strings.CutPrefix(line, marker)
+	if !ok {
+		return Event{}, false, nil
+	}
+	frame = strings.TrimRight(frame, "\r\n")
+
+	sum, data, ok := strings.Cut(frame, " ")
+	if !ok {
+		return Event{}, true, ErrChecksum
+	}
+	expected, err := strconv.ParseUint(sum, 16, 32)
+	if err != nil || crc32.ChecksumIEEE([]byte(data)) != uint32(expected) {
+		return Event{}, true, ErrChecksum
+	}
+
+	var e Event
+	if err := json.Unmarshal([]byte(data), &e); err != nil {
+		return Event{}, true, fmt.Errorf("event: %v", err)
+	}
+	return e, true, nil
+}
+
+// Decoder reads events from the console output of bluebox-init.
+type Decoder struct {
+	scanner *bufio.Scanner
+	seq     int
+	dropped int
+	// corrupted counts the events since the last valid event, that could not be decoded.
+	corrupted int
+}
+
+// NewDecoder returns a Decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &Decoder{scanner: scanner}
+}
+
+// Decode returns the next valid event. Lines without events are skipped. Events that can not be
+// decoded are counted as dropped. At the end of the input io.EOF is returned.
+func (d *Decoder) Decode() (Event, error) {
+	for d.scanner.Scan() {
+		e, ok, err := Parse(d.scanner.Text())
+		if !ok {
+			continue
+		}
+		if err != nil {
+			d.corrupted++
+			continue
+		}
+		// The gap in the sequence numbers includes the corrupted events as well as events
+		// whose frame did not survive at all.
+		if e.Seq > d.seq+1 {
+			d.dropped += e.Seq - d.seq - 1
+		}
+		d.corrupted = 0
+		if e.Seq > d.seq {
+			d.seq = e.Seq
+		}
+		return e, nil
+	}
+	if err := d.scanner.Err(); err != nil {
+		return Event{}, err
+	}
+	return Event{}, io.EOF
+}
+
+// Dropped returns the number of events that were lost or could not be decoded so far.
+func (d *Decoder) Dropped() int {
+	return d.dropped + d.corrupted
+}
+
+// Step holds the reconstructed output and result of an executable.
+type Step struct {
+	// Step is the number of the executable, starting at 1.
+	Step int
+	// Name is the path of the executable inside the archive.
+	Name string
+	// Args holds the arguments of the executable.
+	Args []string
+	// Stdout holds the lines the executable wrote to stdout.
+	Stdout []string
+	// Stderr holds the lines the executable wrote to stderr.
+	Stderr []string
+	// Exited reports whether the exit of the executable was observed.
+	Exited bool
+	// Status is the exit status of the executable.
+	Status int
+	// Signal is the signal that terminated the executable.
+	Signal string
+	// Error describes why the executable could not be run.
+	Error string
+	// Duration is the run time of the executable.
+	Duration time.Duration
+	// Rusage holds the resources used by the executable.
+	Rusage *Rusage
+	// TimedOut reports whether the executable was terminated, because its timeout expired.
+	TimedOut bool
+	// Skipped reports whether the executable was not run, because the deadline expired or an
+	// earlier executable timed out.
+	Skipped bool
+}
+
+// Passed reports whether the executable exited with status 0 before its timeout expired.
+func (s *Step) Passed() bool {
+	return s.Exited && s.Status == 0 && s.Signal == "" && s.Error == "" && !s.TimedOut
+}
+
+// Collect reads all events from r and reconstructs the output and result of every executable in
+// the order they were run. It also returns the number of events that were dropped.
+func Collect(r io.Reader) ([]*Step, int, error) {
+	var steps []*Step
+	byNumber := make(map[int]*Step)
+	step := func(e Event) *Step {
+		s, ok := byNumber[e.Step]
+		if !ok {
+			s = &Step{Step: e.Step, Name: e.Name}
+			byNumber[e.Step] = s
+			steps = append(steps, s)
+		}
+		if s.Name == "" {
+			s.Name = e.Name
+		}
+		return s
+	}
+
+	d := NewDecoder(r)
+	for {
+		e, err := d.Decode()
+		if errors.Is(err, io.EOF) {
+			return steps, d.Dropped(), nil
+		}
+		if err != nil {
+			return steps, d.Dropped(), err
+		}
+
+		switch e.Type {
+		case StepStarted:
+			s := step(e)
+			s.Args = e.Args
+		case StdoutLine:
+			s := step(e)
+			s.Stdout = append(s.Stdout, e.Line)
+		case StderrLine:
+			s := step(e)
+			s.Stderr = append(s.Stderr, e.Line)
+		case StepExited:
+			s := step(e)
+			s.Exited = true
+			if e.Status != nil {
+				s.Status = *e.Status
+			}
+			s.Signal = e.Signal
+			s.Error = e.Error
+			s.Duration = time.Duration(e.Duration)
+			s.Rusage = e.Rusage
+			s.TimedOut = e.TimedOut
+		case StepSkipped:
+			s := step(e)
+			s.Skipped = true
+		}
+	}
+}
+
+// ExtractFiles reads all events from r and writes the files sent with File events into dir. It
+// returns the names of the written files. The input is read completely, even if a file can not be
+// written. Files with missing chunks are reported as error.
+func ExtractFiles(r io.Reader, dir string) ([]string, error) {
+	var names []string
+	received := make(map[string]int64)
+	sizes := make(map[string]int64)
+	var firstErr error
+
+	d := NewDecoder(r)
+	for {
+		e, err := d.Decode()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return names, err
+		}
+		if e.Type != File || firstErr != nil {
+			continue
+		}
+		_, seen := sizes[e.Name]
+		if !seen {
+			names = append(names, e.Name)
+		}
+		sizes[e.Name] = e.Size
+		n, err := writeChunk(dir, e, !seen)
+		if err != nil {
+			firstErr = fmt.Errorf("failed to write %s: %v", e.Name, err)
+			continue
+		}
+		received[e.Name] += n
+	}
+	if firstErr != nil {
+		return names, firstErr
+	}
+	for _, name := range names {
+		if received[name] != sizes[name] {
+			return names, fmt.Errorf("incomplete file %s: received %d of %d bytes", name,
+				received[name], sizes[name])
+		}
+	}
+	return names, nil
+}
+
+// writeChunk writes the chunk of the File event e to its file in dir and returns the number of
+// written bytes. For the first chunk of a file, an existing file is truncated.
+func writeChunk(dir string, e Event, first bool) (int64, error) {
+	if !filepath.IsLocal(filepath.FromSlash(e.Name)) {
+		return 0, errors.New("invalid file name")
+	}
+	data, err := base64.StdEncoding.DecodeString(e.Data)
+	if err != nil {
+		return 0, err
+	}
+	if e.Offset < 0 || e.Offset+int64(len(data)) > e.Size {
+		return 0, fmt.Errorf("chunk at offset %d exceeds size %d", e.Offset, e.Size)
+	}
+
+	file := filepath.Join(dir, filepath.FromSlash(e.Name))
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return 0, err
+	}
+	flags := os.O_CREATE | os.O_WRONLY
+	if first {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(file, flags, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.WriteAt(data, e.Offset); err != nil {
+		f.Close()
+		return 0, err
+	}
+	return int64(len(data)), f.Close()
+}
@@ -0,0 +1,141 @@
+package event
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// frame encodes e the same way bluebox-init does.
+func frame(t *testing.T, e Event) string {
+	t.Helper()
+	data, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("@bluebox %08x %s", crc32.ChecksumIEEE(data), data)
+}
+
+func TestCollect(t *testing.T) {
+	zero, one := 0, 1
+	corrupted := strings.Replace(frame(t, Event{Seq: 5, Type: StdoutLine, Step: 1, Line: "lost"}), "lost", "l[  1.2] ost", 1)
+
+	console := strings.Join([]string{
+		"[    0.000000] Linux version 6.1.0",
+		frame(t, Event{Seq: 1, Type: StepStarted, Step: 1, Name: "pkg.test", Args: []string{"-test.v"}}),
+		frame(t, Event{Seq: 2, Type: StdoutLine, Step: 1, Line: "=== RUN   TestFoo"}),
+		// Event 3 is mixed up with output of the kernel.
+		"[    1.337000] random: crng init done" + frame(t, Event{Seq: 3, Type: StderrLine, Step: 1, Line: "warning"}) + "\r",
+		frame(t, Event{Seq: 4, Type: StderrLine, Step: 1, Line: "error"}) + "\r",
+		corrupted,
+		frame(t, Event{Seq: 6, Type: StdoutLine, Step: 1, Line: "PASS"}),
+		frame(t, Event{Seq: 7, Type: StepExited, Step: 1, Name: "pkg.test", Status: &zero, Rusage: &Rusage{MaxRSS: 42}}),
+		frame(t, Event{Seq: 8, Type: StepStarted, Step: 2, Name: "other.test"}),
+		// Event 9 is lost completely.
+		frame(t, Event{Seq: 10, Type: StepExited, Step: 2, Name: "other.test", Status: &one}),
+		frame(t, Event{Seq: 11, Type: Shutdown, Name: "poweroff", Exit: &one}),
+	}, "\n")
+
+	steps, dropped, err := Collect(strings.NewReader(console))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 3 {
+		t.Fatalf("expected 3 dropped events but got %d", dropped)
+	}
+
+	expected := []*Step{
+		{
+			Step:   1,
+			Name:   "pkg.test",
+			Args:   []string{"-test.v"},
+			Stdout: []string{"=== RUN   TestFoo", "PASS"},
+			Stderr: []string{"error"},
+			Exited: true,
+			Rusage: &Rusage{MaxRSS: 42},
+		},
+		{
+			Step:   2,
+			Name:   "other.test",
+			Exited: true,
+			Status: 1,
+		},
+	}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Fatalf("steps did not match. Got: %#v\nExpected: %#v", steps, expected)
+	}
+	if !steps[0].Passed() || steps[1].Passed() {
+		t.Fatal("unexpected result of steps")
+	}
+}
+
+func TestParse(t *testing.T) {
+	if _, ok, _ := Parse("[            ] stdout: @bluebox"); ok {
+		t.Fatal("expected no event")
+	}
+	spoofed := frame(t, Event{Seq: 1, Type: Shutdown, Name: "poweroff"})
+	if _, ok, _ := Parse("[            ] stdout: " + spoofed); ok {
+		t.Fatal("expected no event for the marker inside of a line")
+	}
+	if _, ok, err := Parse("@bluebox 00000000 {}"); !ok || err != ErrChecksum {
+		t.Fatalf("expected checksum error but got %v", err)
+	}
+	e, ok, err := Parse(frame(t, Event{Seq: 1, Type: Shutdown, Name: "poweroff"}))
+	if !ok || err != nil {
+		t.Fatalf("expected event but got %v", err)
+	}
+	if e.Type != Shutdown || e.Name != "poweroff" {
+		t.Fatalf("unexpected event %#v", e)
+	}
+}
+
+func TestExtractFiles(t *testing.T) {
+	chunk := func(seq int, name, data string, offset, size int64) string {
+		return frame(t, Event{
+			Seq: seq, Type: File, Name: name, Offset: offset, Size: size,
+			Data: base64.StdEncoding.EncodeToString([]byte(data)),
+		})
+	}
+
+	console := strings.Join([]string{
+		"[    0.000000] Linux version 6.1.0",
+		chunk(1, "covmeta.1234", "meta", 0, 4),
+		chunk(2, "covcounters.1234.1.1", "count", 0, 10),
+		"[    1.337000] random: crng init done",
+		"[            ] stdout: " + chunk(3, "spoofed", "data", 0, 4),
+		chunk(3, "covcounters.1234.1.1", "ers!!", 5, 10),
+		frame(t, Event{Seq: 4, Type: Shutdown, Name: "poweroff"}),
+	}, "\n")
+
+	dir := t.TempDir()
+	names, err := ExtractFiles(strings.NewReader(console), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"covmeta.1234", "covcounters.1234.1.1"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %q but got %q", expected, names)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "covcounters.1234.1.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "counters!!" {
+		t.Fatalf("unexpected content %q", data)
+	}
+
+	// The second chunk is lost.
+	incomplete := chunk(1, "covmeta.1234", "meta", 0, 8)
+	if _, err := ExtractFiles(strings.NewReader(incomplete), dir); err == nil {
+		t.Fatal("expected an error for an incomplete file")
+	}
+	escape := chunk(1, "../covmeta.1234", "meta", 0, 4)
+	if _, err := ExtractFiles(strings.NewReader(escape), dir); err == nil {
+		t.Fatal("expected an error for an invalid name")
+	}
+}
@@ -0,0 +1,139 @@
+package initramfs
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/florianl/bluebox/event"
+	exec "golang.org/x/sys/execabs"
+)
+
+// runBlueboxInit builds bluebox-init of b with DumpInit into dir, where the executables of b were
+// written to, and runs it as PID 1 of a new PID namespace. bluebox-init skips the shutdown, if the
+// root file system is not a tmpfs, and otherwise only terminates the PID namespace. It returns
+// stdout and stderr of bluebox-init.
+func runBlueboxInit(t *testing.T, b *Bluebox, dir string) (string, string) {
+	t.Helper()
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skipf("no shell to run %s: %v", buildScript, err)
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skipf("no Go toolchain to build bluebox-init: %v", err)
+	}
+	b.SetPrebuilt(false)
+	if err := b.DumpInit(dir); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command(sh, filepath.Join(dir, buildScript)).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(filepath.Join(dir, "bluebox-init"))
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Orphaned children are only reparented to bluebox-init, if it runs as PID 1.
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWPID | syscall.CLONE_NEWUSER,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("failed to run bluebox-init in a new PID namespace: %v", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("%v: %s", err, stderr.String())
+	}
+	return stdout.String(), stderr.String()
+}
+
+// writeScript writes a shell script with body to dir and returns its path.
+func writeScript(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunSteps(t *testing.T) {
+	dir := t.TempDir()
+	b := New()
+	b.SetEventStream(true)
+	b.SetDeadline(3 * time.Second)
+	b.SetKillDelay(500 * time.Millisecond)
+	for _, s := range []Step{
+		// The background sleep is orphaned, once the inner shell exited, and reaped by
+		// bluebox-init while the step still runs.
+		{Executable: writeScript(t, dir, "orphan.sh", "sh -c 'sleep 0.1 &'\nsleep 0.5\necho done")},
+		// Ignoring SIGTERM is inherited by sleep, so only SIGKILL stops the step.
+		{Executable: writeScript(t, dir, "stubborn.sh", "trap '' TERM\nsleep 60"), Timeout: 500 * time.Millisecond},
+		// Without a timeout of its own, the step is terminated once the deadline expired.
+		{Executable: writeScript(t, dir, "late.sh", "exec sleep 60")},
+		{Executable: writeScript(t, dir, "skipped.sh", "echo skipped")},
+	} {
+		if err := b.AddStep(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stdout, stderr := runBlueboxInit(t, b, dir)
+
+	steps, dropped, err := event.Collect(strings.NewReader(stdout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 0 {
+		t.Fatalf("%d events were dropped", dropped)
+	}
+	if len(steps) != 4 {
+		t.Fatalf("expected events of 4 steps but got %d:\n%s", len(steps), stdout)
+	}
+	if s := steps[0]; s.Name != "orphan.sh" || !s.Passed() || strings.Join(s.Stdout, "\n") != "done" {
+		t.Fatalf("unexpected result of the step with an orphan: %#v", s)
+	}
+	if s := steps[1]; s.Name != "stubborn.sh" || !s.TimedOut || s.Signal != "killed" {
+		t.Fatalf("expected stubborn.sh to be killed after its timeout: %#v", s)
+	}
+	if s := steps[2]; s.Name != "late.sh" || !s.TimedOut || s.Signal != "terminated" {
+		t.Fatalf("expected late.sh to be terminated by the deadline: %#v", s)
+	}
+	if s := steps[3]; s.Name != "skipped.sh" || !s.Skipped || s.Exited {
+		t.Fatalf("expected skipped.sh to be skipped after the deadline: %#v", s)
+	}
+
+	for _, msg := range []string{
+		"Reaped orphaned PID",
+		"Timeout expired, sending terminated",
+		"Timeout expired, sending killed",
+		"Deadline of 3s expired, skipping remaining executables",
+	} {
+		if !strings.Contains(stderr, msg) {
+			t.Fatalf("expected %q in the output of bluebox-init:\n%s", msg, stderr)
+		}
+	}
+	if strings.Contains(stderr, "Watchdog expired") {
+		t.Fatalf("unexpected expiry of the watchdog:\n%s", stderr)
+	}
+
+	var result Result
+	found := false
+	scanner := bufio.NewScanner(strings.NewReader(stdout))
+	for scanner.Scan() {
+		if r, ok := ParseResult(scanner.Text()); ok {
+			result, found = r, true
+		}
+	}
+	if expected := (Result{Steps: 4, Passed: 1, Failed: 3, Exit: 1}); !found || result != expected {
+		t.Fatalf("expected result %#v but got %#v", expected, result)
+	}
+}
@@ -0,0 +1,237 @@
+package initramfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	exec "golang.org/x/sys/execabs"
+)
+
+// keyEnv lists the variables of go env, that change the result of go build for the init programs.
+var keyEnv = []string{
+	"GOVERSION", "GOOS", "GOARCH", "CGO_ENABLED", "GOFLAGS", "GOEXPERIMENT", "GOTOOLCHAIN",
+	"GO386", "GOAMD64", "GOARM", "GOARM64", "GOMIPS", "GOMIPS64", "GOPPC64", "GORISCV64",
+}
+
+// CacheEntry describes a compiled init program in the build cache.
+type CacheEntry struct {
+	// Key is the SHA-256 of the source, the build flags and the Go toolchain.
+	Key string
+	// Path is the location of the executable.
+	Path string
+	// Size of the executable in bytes.
+	Size int64
+	// LastUsed is the time the executable was built or last taken from the cache.
+	LastUsed time.Time
+}
+
+// cacheTag marks a directory as build cache of bluebox, so ListCache and PruneCache never touch
+// files in other directories. It follows the Cache Directory Tagging Specification, so backup
+// tools can skip the cache as well.
+const (
+	cacheTagFile = "CACHEDIR.TAG"
+	cacheTag     = "Signature: 8a477f597d28d172789f06886806bc55\n" +
+		"# This file is a cache directory tag created by bluebox.\n"
+)
+
+// userCacheDir returns the base directory of DefaultCacheDir.
+var userCacheDir = os.UserCacheDir
+
+// DefaultCacheDir returns the directory of the build cache, that is used by default. It is the
+// directory bluebox inside os.UserCacheDir.
+func DefaultCacheDir() (string, error) {
+	dir, err := userCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "bluebox"), nil
+}
+
+// SetCacheDir sets the directory of the build cache for the compiled init programs. Generated
+// programs, that were already built with the same Go toolchain, build flags and environment, are
+// taken from the cache instead of being compiled again. If dir is empty, the cache is disabled.
+// By default DefaultCacheDir is used.
+func (b *Bluebox) SetCacheDir(dir string) {
+	b.cacheDir = dir
+}
+
+// cacheKey returns the key of the Go program src in the build cache. It covers the source, the
+// build flags and the configuration of the Go toolchain in the environment env.
+func cacheKey(goBin string, env, flags []string, src string) (string, error) {
+	cmd := exec.Command(goBin, append([]string{"env"}, keyEnv...)...)
+	cmd.Env = env
+	goEnv, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("go env: %v", err)
+	}
+	source, err := os.ReadFile(src)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "env %q\nflags %q\nsource %d\n", goEnv, flags, len(source))
+	h.Write(source)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cachePath returns the location of the executable with key inside the cache dir.
+func cachePath(dir, key string) string {
+	return filepath.Join(dir, key[:2], key)
+}
+
+// cacheGet copies the executable with key from the cache dir to out. It returns false, if the
+// executable is not cached.
+func cacheGet(dir, key, out string) bool {
+	p := cachePath(dir, key)
+	if err := copyExecutable(p, out); err != nil {
+		return false
+	}
+	// The modification time tracks the last use for PruneCache.
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return true
+}
+
+// cachePut adds the executable out with key to the cache dir. The executable is written to a
+// temporary file first, so concurrent builds never see a partial executable.
+func cachePut(dir, key, out string) error {
+	p := cachePath(dir, key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	if !isCache(dir) {
+		if err := os.WriteFile(filepath.Join(dir, cacheTagFile), []byte(cacheTag), 0o644); err != nil {
+			return err
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), key+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	if err := copyExecutable(out, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// copyExecutable copies the file src to dst with the same permission bits.
+func copyExecutable(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Chmod(fi.Mode().Perm()); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// isCache reports whether dir holds the tag of a build cache of bluebox.
+func isCache(dir string) bool {
+	data, err := os.ReadFile(filepath.Join(dir, cacheTagFile))
+	return err == nil && string(data) == cacheTag
+}
+
+// isKey reports whether name is a key of the build cache.
+func isKey(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
+
+// ListCache returns the compiled init programs in the build cache dir. Only files, that are
+// named like the executables bluebox adds to the cache, are listed. It returns an error, if dir
+// exists, but was not created as build cache by bluebox.
+func ListCache(dir string) ([]CacheEntry, error) {
+	subdirs, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list build cache: %v", err)
+	}
+	if !isCache(dir) {
+		return nil, fmt.Errorf("%s is not a build cache of bluebox, as it has no %s", dir, cacheTagFile)
+	}
+
+	var entries []CacheEntry
+	for _, sub := range subdirs {
+		if !sub.IsDir() || len(sub.Name()) != 2 {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(dir, sub.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list build cache: %v", err)
+		}
+		for _, f := range files {
+			if !f.Type().IsRegular() || !isKey(f.Name()) || !strings.HasPrefix(f.Name(), sub.Name()) {
+				continue
+			}
+			info, err := f.Info()
+			if err != nil {
+				return nil, fmt.Errorf("failed to list build cache: %v", err)
+			}
+			entries = append(entries, CacheEntry{
+				Key:      f.Name(),
+				Path:     filepath.Join(dir, sub.Name(), f.Name()),
+				Size:     info.Size(),
+				LastUsed: info.ModTime(),
+			})
+		}
+	}
+	return entries, nil
+}
+
+// PruneCache removes the compiled init programs from the build cache dir, that were not used
+// within maxAge, and returns the removed entries. If maxAge is zero, all entries are removed.
+func PruneCache(dir string, maxAge time.Duration) ([]CacheEntry, error) {
+	entries, err := ListCache(dir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []CacheEntry
+	for _, e := range entries {
+		if maxAge != 0 && time.Since(e.LastUsed) <= maxAge {
+			continue
+		}
+		if err := os.Remove(e.Path); err != nil {
+			return removed, fmt.Errorf("failed to remove %s: %v", e.Key, err)
+		}
+		// Remove the parent directory, once it is empty.
+		os.Remove(filepath.Dir(e.Path))
+		removed = append(removed, e)
+	}
+	return removed, nil
+}
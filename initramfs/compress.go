@@ -0,0 +1,111 @@
+package initramfs
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+
+	exec "golang.org/x/sys/execabs"
+)
+
+// Compressor compresses the generated initramfs archive. The Linux kernel needs to be built with
+// support for the used format to be able to extract the archive.
+type Compressor interface {
+	// NewWriter returns a writer that compresses everything written to it and passes the
+	// result to w. All data is written to w, once the returned writer is closed.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// CompressorFunc is an adapter to allow the use of ordinary functions as Compressor.
+type CompressorFunc func(w io.Writer) (io.WriteCloser, error)
+
+// NewWriter calls f(w).
+func (f CompressorFunc) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return f(w)
+}
+
+// Gzip compresses the archive with gzip. It does not depend on external programs.
+var Gzip Compressor = CompressorFunc(func(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, gzip.BestCompression)
+})
+
+// Command returns a Compressor that pipes the archive through the external program name with
+// the given args. The program is expected to read from stdin and write to stdout.
+func Command(name string, args ...string) Compressor {
+	return CompressorFunc(func(w io.Writer) (io.WriteCloser, error) {
+		cmd := exec.Command(name, args...)
+		cmd.Stdout = w
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("failed to start %s: %v", name, err)
+		}
+		return &commandWriter{WriteCloser: stdin, cmd: cmd}, nil
+	})
+}
+
+// commandWriter writes to the stdin of an external program.
+type commandWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+// Close closes stdin and waits for the external program to finish.
+func (c *commandWriter) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		c.cmd.Wait()
+		return err
+	}
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %v", c.cmd.Path, err)
+	}
+	return nil
+}
+
+var (
+	compressorsMu sync.Mutex
+	// compressors maps names to the known compressors. Besides gzip, the options for the
+	// external programs follow the recommendations of the Linux kernel.
+	compressors = map[string]Compressor{
+		"gzip": Gzip,
+		"zstd": Command("zstd", "-q", "-c"),
+		"xz":   Command("xz", "-q", "-c", "--check=crc32", "--lzma2=dict=1MiB"),
+		"lz4":  Command("lz4", "-q", "-c", "-l"),
+	}
+)
+
+// RegisterCompressor makes c available by name to CompressorByName. If a Compressor with the same
+// name already exists, it is replaced. This allows to replace the external programs that are
+// used by default for zstd, xz and lz4 with Go implementations.
+func RegisterCompressor(name string, c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[name] = c
+}
+
+// CompressorByName returns the Compressor registered for name. For "none" or an empty name, nil
+// is returned, which disables compression.
+func CompressorByName(name string) (Compressor, error) {
+	if name == "" || name == "none" {
+		return nil, nil
+	}
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	c, ok := compressors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression '%s'", name)
+	}
+	return c, nil
+}
+
+// Compressors returns the sorted names of all registered compressors.
+func Compressors() []string {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	return slices.Sorted(maps.Keys(compressors))
+}
@@ -0,0 +1,165 @@
+package initramfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// ConfigFile is the name of the file in the root of every archive, that holds the Config of the
+// init programs.
+const ConfigFile = "bluebox.json"
+
+// configVersion is the version of the format of ConfigFile.
+const configVersion = 1
+
+// Config describes how the init programs of an archive are configured. It is written as ConfigFile
+// into every archive. Prebuilt init programs read their configuration from it at boot, while
+// compiled init programs have it built in and the file only serves for inspection.
+type Config struct {
+	// Version of the format of the configuration.
+	Version int `json:"version"`
+	// Arch is the GOARCH value of the init programs.
+	Arch string `json:"arch"`
+	// Prebuilt reports whether the archive holds the generic, prebuilt init programs.
+	Prebuilt bool `json:"prebuilt"`
+
+	// Mounts holds the file systems mounted by init in this order.
+	Mounts []Mount `json:"mounts,omitempty"`
+	// Nodes holds the device nodes created by init.
+	Nodes []ConfigNode `json:"nodes,omitempty"`
+	// ArchiveNodes holds the absolute paths of the device nodes below /dev, that are part of
+	// the archive. Unlike the rest of /dev, init moves them to the new root file system.
+	ArchiveNodes []string `json:"archive_nodes,omitempty"`
+	// Modules holds the kernel modules loaded by init in this order.
+	Modules []ConfigModule `json:"modules,omitempty"`
+	// ModuleErrorsFatal stops init, if a kernel module can not be loaded.
+	ModuleErrorsFatal bool `json:"module_errors_fatal,omitempty"`
+	// Links holds the network interfaces configured by init.
+	Links []Link `json:"links,omitempty"`
+	// Routes holds the routes added by init.
+	Routes []Route `json:"routes,omitempty"`
+
+	// Env holds the environment variables of the executables in the form KEY=value.
+	Env []string `json:"env,omitempty"`
+	// Steps holds the executables run by bluebox-init in this order.
+	Steps []ConfigStep `json:"steps,omitempty"`
+	// DebugExitPort is the I/O port of the isa-debug-exit device, if not zero.
+	DebugExitPort uint16 `json:"debug_exit_port,omitempty"`
+	// Events enables the structured output of bluebox-init.
+	Events bool `json:"events,omitempty"`
+	// Deadline limits the run time of all executables, if not zero.
+	Deadline time.Duration `json:"deadline_ns,omitempty"`
+	// KillDelay is the time between SIGTERM and SIGKILL, once a timeout expired.
+	KillDelay time.Duration `json:"kill_delay_ns"`
+	// StopOnTimeout skips the remaining executables, once the timeout of an executable expired.
+	StopOnTimeout bool `json:"stop_on_timeout,omitempty"`
+	// ArtifactsDir is written to ArtifactsDevice once all executables finished, if not empty.
+	ArtifactsDir string `json:"artifacts_dir,omitempty"`
+	// ArtifactsDevice is the raw block device, that receives the artifacts.
+	ArtifactsDevice string `json:"artifacts_device,omitempty"`
+	// CoverDir is set as GOCOVERDIR for the executables, if not empty.
+	CoverDir string `json:"cover_dir,omitempty"`
+	// SendCoverage writes the coverage data as file events to the console.
+	SendCoverage bool `json:"send_coverage,omitempty"`
+}
+
+// ConfigNode describes a device node, that is created by init.
+type ConfigNode struct {
+	// Path is the absolute path of the device node.
+	Path string `json:"path"`
+	// Mode holds the file type and permission bits as used by mknod(2).
+	Mode uint32 `json:"mode"`
+	// Dev is the device number in the encoding of the Linux kernel.
+	Dev uint64 `json:"dev"`
+}
+
+// ConfigModule describes a kernel module, that is loaded by init.
+type ConfigModule struct {
+	// Path is the absolute path of the module.
+	Path string `json:"path"`
+	// Params holds the module parameters separated by spaces.
+	Params string `json:"params,omitempty"`
+}
+
+// ConfigStep describes an executable, that is run by bluebox-init.
+type ConfigStep struct {
+	// Path of the executable relative to the root of the archive.
+	Path string `json:"path"`
+	// Args holds the arguments of the executable.
+	Args []string `json:"args,omitempty"`
+	// Timeout limits the run time of the executable, if not zero.
+	Timeout time.Duration `json:"timeout_ns,omitempty"`
+}
+
+// config returns the configuration of the init programs.
+func (b *Bluebox) config(prebuilt bool) Config {
+	c := Config{
+		Version:           configVersion,
+		Arch:              b.arch,
+		Prebuilt:          prebuilt,
+		Mounts:            b.mounts,
+		ArchiveNodes:      b.archiveNodes(),
+		ModuleErrorsFatal: b.moduleErrorsFatal,
+		Links:             b.links,
+		Routes:            b.routes,
+		DebugExitPort:     b.debugExitPort,
+		Events:            b.events,
+		Deadline:          b.deadline,
+		KillDelay:         b.killDelay,
+		StopOnTimeout:     b.stopOnTimeout,
+		ArtifactsDir:      b.artifactsDir,
+		ArtifactsDevice:   b.artifactsDevice,
+	}
+	for _, n := range b.nodes {
+		c.Nodes = append(c.Nodes, ConfigNode{Path: n.path, Mode: n.mode, Dev: n.dev})
+	}
+	for _, m := range b.modules {
+		c.Modules = append(c.Modules, ConfigModule{Path: "/" + m.path, Params: m.params})
+	}
+	for _, env := range b.envVars {
+		c.Env = append(c.Env, env.Key+"="+env.Value)
+	}
+	for _, exe := range b.execs {
+		c.Steps = append(c.Steps, ConfigStep{Path: exe.dst, Args: exe.args, Timeout: exe.timeout})
+	}
+	c.CoverDir, c.SendCoverage = b.coverDir()
+	return c
+}
+
+// coverDir returns the directory, that is set as GOCOVERDIR, and whether the coverage data is
+// sent to the console. Coverage data is written to the artifacts disk, if there is one, and to
+// the console otherwise.
+func (b *Bluebox) coverDir() (string, bool) {
+	switch {
+	case !b.coverage:
+		return "", false
+	case b.artifactsDir != "":
+		return path.Join(b.artifactsDir, "coverage"), false
+	}
+	return "/coverage", true
+}
+
+// writeConfig writes the configuration of the init programs as ConfigFile into dir.
+func (b *Bluebox) writeConfig(dir string, prebuilt bool) error {
+	data, err := json.MarshalIndent(b.config(prebuilt), "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode configuration: %v", err)
+	}
+	return os.WriteFile(filepath.Join(dir, ConfigFile), append(data, '\n'), 0o644)
+}
+
+// ParseConfig decodes the configuration of the init programs from the content of ConfigFile.
+func ParseConfig(data []byte) (Config, error) {
+	var c Config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return Config{}, fmt.Errorf("invalid %s: %v", ConfigFile, err)
+	}
+	if c.Version != configVersion {
+		return Config{}, fmt.Errorf("unsupported version %d of %s", c.Version, ConfigFile)
+	}
+	return c, nil
+}
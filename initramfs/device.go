@@ -0,0 +1,159 @@
+package initramfs
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cavaliergopher/cpio"
+)
+
+// DeviceType is the type of a device node.
+type DeviceType int
+
+const (
+	// CharDevice is a character device like /dev/net/tun.
+	CharDevice DeviceType = iota
+	// BlockDevice is a block device like /dev/loop0.
+	BlockDevice
+)
+
+// Mode bits of device nodes as used by mknod(2). They are defined here, so they are also
+// available when bluebox itself is not built for Linux.
+const (
+	modeCharDevice  = 0o020000 // S_IFCHR
+	modeBlockDevice = 0o060000 // S_IFBLK
+)
+
+// mode returns the file type bits of t for mknod(2).
+func (t DeviceType) mode() (uint32, error) {
+	switch t {
+	case CharDevice:
+		return modeCharDevice, nil
+	case BlockDevice:
+		return modeBlockDevice, nil
+	}
+	return 0, fmt.Errorf("unknown device type %d", t)
+}
+
+// Limits of device numbers, that are supported by the Linux kernel.
+const (
+	maxMajor = 1<<12 - 1
+	maxMinor = 1<<20 - 1
+)
+
+// checkDevice returns an error, if the Linux kernel does not support the device number.
+func checkDevice(major, minor uint32) error {
+	if major > maxMajor || minor > maxMinor {
+		return fmt.Errorf("device number %d:%d is out of range, major is limited to %d and minor to %d",
+			major, minor, maxMajor, maxMinor)
+	}
+	return nil
+}
+
+// mkdev returns the device number for major and minor in the encoding of the Linux kernel.
+func mkdev(major, minor uint32) uint64 {
+	return uint64(minor&0xff) | uint64(major&0xfff)<<8 |
+		uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+}
+
+// defaultNodes lists the device nodes, that are created by default.
+var defaultNodes = []nod{
+	{path: "/dev/tty", mode: modeCharDevice | 0o666, dev: mkdev(5, 0)},
+	{path: "/dev/urandom", mode: modeCharDevice | 0o444, dev: mkdev(1, 9)},
+}
+
+// Mknod adds a device node at the absolute path p, that is created by the generated init once all
+// file systems are mounted. Missing parent directories are created. If there is already a device
+// node at p, it is replaced. By default /dev/tty and /dev/urandom are created.
+func (b *Bluebox) Mknod(p string, t DeviceType, major, minor uint32, perm fs.FileMode) error {
+	mode, err := t.mode()
+	if err != nil {
+		return err
+	}
+	if err := checkDevice(major, minor); err != nil {
+		return err
+	}
+	if !path.IsAbs(p) {
+		return fmt.Errorf("device node %s is not an absolute path", p)
+	}
+	p = path.Clean(p)
+	if p == "/" {
+		return fmt.Errorf("invalid path %s for device node", p)
+	}
+
+	n := nod{path: p, mode: mode | uint32(perm.Perm()), dev: mkdev(major, minor)}
+	for i, existing := range b.nodes {
+		if existing.path == p {
+			b.nodes[i] = n
+			return nil
+		}
+	}
+	b.nodes = append(b.nodes, n)
+	return nil
+}
+
+// EmbedDevice writes a device node at dst into the archive. Unlike Mknod, the device node is part
+// of the archive itself. Device nodes below /dev are hidden, if devtmpfs is mounted at /dev,
+// which is the default. So this is mostly useful for kernels without devtmpfs support.
+func (b *Bluebox) EmbedDevice(dst string, t DeviceType, major, minor uint32, perm fs.FileMode) error {
+	if _, err := t.mode(); err != nil {
+		return err
+	}
+	if err := checkDevice(major, minor); err != nil {
+		return err
+	}
+	name := path.Clean(strings.TrimLeft(filepath.ToSlash(dst), "/"))
+	if top, _, _ := strings.Cut(name, "/"); top != "dev" || name == "dev" {
+		// Files below /dev are rejected by archivePath.
+		var err error
+		if name, err = archivePath(dst); err != nil {
+			return err
+		}
+	}
+	if src, ok := b.source(name); ok {
+		return fmt.Errorf("%s is already used by %s", name, src)
+	}
+	for _, e := range b.embeddings {
+		if e.dst == name {
+			return fmt.Errorf("%s is already embedded", name)
+		}
+	}
+
+	mode := fs.ModeDevice | perm.Perm()
+	if t == CharDevice {
+		mode |= fs.ModeCharDevice
+	}
+	b.embeddings = append(b.embeddings, embedding{
+		src:   name,
+		dst:   name,
+		mode:  mode,
+		major: major,
+		minor: minor,
+	})
+	return nil
+}
+
+// archiveNodes returns the absolute paths of the device nodes below /dev, that are embedded into
+// the archive.
+func (b *Bluebox) archiveNodes() []string {
+	var nodes []string
+	for _, e := range b.embeddings {
+		if e.mode&fs.ModeDevice != 0 && strings.HasPrefix(e.dst, "dev/") {
+			nodes = append(nodes, "/"+e.dst)
+		}
+	}
+	return nodes
+}
+
+// addDevice adds a device node with the given header to the archive.
+func addDevice(w *newcWriter, hdr *newcHeader, mode fs.FileMode, major, minor uint32) error {
+	hdr.mode = cpio.TypeBlock | cpioPerm(mode)
+	if mode&fs.ModeCharDevice != 0 {
+		hdr.mode = cpio.TypeChar | cpioPerm(mode)
+	}
+	hdr.rmajor, hdr.rminor = major, minor
+	return w.add(hdr, nil)
+}
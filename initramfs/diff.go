@@ -0,0 +1,233 @@
+package initramfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"slices"
+	"strconv"
+)
+
+// Change is the kind of difference of an entry between two archives.
+type Change string
+
+const (
+	// Added entries exist only in the second archive.
+	Added Change = "added"
+	// Removed entries exist only in the first archive.
+	Removed Change = "removed"
+	// Modified entries exist in both archives, but differ.
+	Modified Change = "modified"
+)
+
+// FieldDiff is a differing property of an entry or the configuration. A value, that is missing in
+// one of the archives, is empty.
+type FieldDiff struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// EntryDiff is the difference of an entry between two archives.
+type EntryDiff struct {
+	Name   string      `json:"name"`
+	Change Change      `json:"change"`
+	Fields []FieldDiff `json:"fields,omitempty"`
+}
+
+// Diff holds the differences between two archives.
+type Diff struct {
+	Entries []EntryDiff `json:"entries,omitempty"`
+	// Config lists the differences of the configuration of the init programs in ConfigFile.
+	// Fields are named by their path in ConfigFile, e.g. steps[0].args.
+	Config []FieldDiff `json:"config,omitempty"`
+}
+
+// Empty reports whether the archives are the same.
+func (d Diff) Empty() bool {
+	return len(d.Entries) == 0 && len(d.Config) == 0
+}
+
+// entryFields are the compared properties of entries in the order they are reported.
+var entryFields = []string{"mode", "owner", "size", "sha256", "linkname", "device"}
+
+// entryInfo holds the properties of an entry, that are compared.
+type entryInfo struct {
+	Entry
+	sha256 string
+}
+
+// fields returns the compared properties of the entry. Properties, that do not apply to the type
+// of the entry, are empty.
+func (e entryInfo) fields() map[string]string {
+	fields := map[string]string{
+		"mode":     e.Mode.String(),
+		"owner":    fmt.Sprintf("%d:%d", e.Uid, e.Gid),
+		"size":     strconv.FormatInt(e.Size, 10),
+		"sha256":   e.sha256,
+		"linkname": e.Linkname,
+	}
+	if e.Mode&fs.ModeDevice != 0 {
+		fields["device"] = fmt.Sprintf("%d:%d", e.Major, e.Minor)
+	}
+	return fields
+}
+
+// readEntries returns the entries of the archive r by name and the content of ConfigFile. As the
+// Linux kernel does, later entries replace earlier ones with the same name.
+func readEntries(r io.Reader) (map[string]entryInfo, []byte, error) {
+	entries := make(map[string]entryInfo)
+	var config []byte
+	err := Walk(r, func(e Entry, r io.Reader) error {
+		info := entryInfo{Entry: e}
+		if e.Mode.IsRegular() {
+			h := sha256.New()
+			if e.Name == ConfigFile {
+				var err error
+				if config, err = io.ReadAll(r); err != nil {
+					return err
+				}
+				h.Write(config)
+			} else if _, err := io.Copy(h, r); err != nil {
+				return err
+			}
+			info.sha256 = hex.EncodeToString(h.Sum(nil))
+		}
+		entries[e.Name] = info
+		return nil
+	})
+	return entries, config, err
+}
+
+// Compare returns the differences between the initramfs archives a and b. Entries are compared by
+// mode, owner, size, SHA-256 of the content, link target and device number. Modification times
+// are not compared, as they differ unless the archives are reproducible. If both archives hold a
+// ConfigFile, the configurations of the init programs are compared as well.
+func Compare(a, b io.Reader) (Diff, error) {
+	var d Diff
+	oldEntries, oldConfig, err := readEntries(a)
+	if err != nil {
+		return d, fmt.Errorf("failed to read first archive: %v", err)
+	}
+	newEntries, newConfig, err := readEntries(b)
+	if err != nil {
+		return d, fmt.Errorf("failed to read second archive: %v", err)
+	}
+
+	names := slices.Collect(maps.Keys(oldEntries))
+	for name := range newEntries {
+		if _, ok := oldEntries[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		o, inOld := oldEntries[name]
+		n, inNew := newEntries[name]
+		switch {
+		case !inNew:
+			d.Entries = append(d.Entries, EntryDiff{Name: name, Change: Removed})
+		case !inOld:
+			d.Entries = append(d.Entries, EntryDiff{Name: name, Change: Added})
+		default:
+			if fields := diffFields(o.fields(), n.fields()); len(fields) > 0 {
+				d.Entries = append(d.Entries, EntryDiff{Name: name, Change: Modified, Fields: fields})
+			}
+		}
+	}
+
+	if oldConfig != nil && newConfig != nil {
+		if d.Config, err = compareConfig(oldConfig, newConfig); err != nil {
+			return d, err
+		}
+	}
+	return d, nil
+}
+
+// diffFields returns the properties, that differ between a and b.
+func diffFields(a, b map[string]string) []FieldDiff {
+	var diffs []FieldDiff
+	for _, field := range entryFields {
+		if a[field] != b[field] {
+			diffs = append(diffs, FieldDiff{Field: field, Old: a[field], New: b[field]})
+		}
+	}
+	return diffs
+}
+
+// compareConfig returns the differences between the content of two ConfigFiles.
+func compareConfig(a, b []byte) ([]FieldDiff, error) {
+	oldConfig, err := ParseConfig(a)
+	if err != nil {
+		return nil, err
+	}
+	newConfig, err := ParseConfig(b)
+	if err != nil {
+		return nil, err
+	}
+
+	oldValues, err := flattenConfig(oldConfig)
+	if err != nil {
+		return nil, err
+	}
+	newValues, err := flattenConfig(newConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := slices.Collect(maps.Keys(oldValues))
+	for field := range newValues {
+		if _, ok := oldValues[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	slices.Sort(fields)
+
+	var diffs []FieldDiff
+	for _, field := range fields {
+		if oldValues[field] != newValues[field] {
+			diffs = append(diffs, FieldDiff{Field: field, Old: oldValues[field], New: newValues[field]})
+		}
+	}
+	return diffs, nil
+}
+
+// flattenConfig returns the JSON encoded values of c by their path in ConfigFile.
+func flattenConfig(c Config) (map[string]string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	flatten(values, "", v)
+	return values, nil
+}
+
+// flatten adds the JSON encoded leaves of v with their path below prefix to values.
+func flatten(values map[string]string, prefix string, v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if prefix != "" {
+				k = prefix + "." + k
+			}
+			flatten(values, k, e)
+		}
+	case []any:
+		for i, e := range v {
+			flatten(values, fmt.Sprintf("%s[%d]", prefix, i), e)
+		}
+	default:
+		data, _ := json.Marshal(v)
+		values[prefix] = string(data)
+	}
+}
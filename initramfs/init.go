@@ -2,102 +2,277 @@ package initramfs
 
 import (
 	"context"
+	_ "embed"
 	"fmt"
+	"go/parser"
+	"go/token"
 	"os"
 	"path/filepath"
-	"syscall"
+	"strings"
 	"text/template"
 
 	exec "golang.org/x/sys/execabs"
 )
 
-// createInit writes a Go program and compiles it so it can be used as init.
-func (b *Bluebox) createInit(dir string) error {
-	f, err := os.OpenFile(filepath.Join(dir, "init.go"), os.O_CREATE|os.O_WRONLY, 0o600)
+// createInit writes a Go program and compiles it so it can be used as init. If generic is set, the
+// program reads its configuration from ConfigFile instead of having it built in.
+func (b *Bluebox) createInit(dir string, generic bool) error {
+	src, err := b.writeInit(dir, generic)
 	if err != nil {
 		return err
 	}
+	return b.build(src, filepath.Join(dir, "init"))
+}
+
+// writeInit writes the Go program of init to dir and returns its path.
+func (b *Bluebox) writeInit(dir string, generic bool) (string, error) {
+	f, err := os.OpenFile(filepath.Join(dir, "init.go"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
 
 	config := initTemplateConfig{
-		Environment: []environment{
-			mount{source: "devtmpfs", target: "/dev", fstype: "devtmpfs", flags: 0, data: "", targetPerm: 0o755, targetCreate: true},
-			mount{source: "tmpfs", target: "/tmp", fstype: "tmpfs", flags: 0, data: "", targetPerm: 0o755, targetCreate: true},
-			mount{source: "proc", target: "/proc", fstype: "proc", flags: 0, data: "", targetPerm: 0o555, targetCreate: true},
-			nod{path: "/dev/tty", mode: syscall.S_IFCHR | 0o666, dev: 0x0500},
-			nod{path: "/dev/urandom", mode: syscall.S_IFCHR | 0o444, dev: 0x0109},
-			mount{source: "sysfs", target: "/sys", fstype: "sysfs", flags: 0, data: "", targetPerm: 0o555, targetCreate: true},
-			mount{source: "securityfs", target: "/sys/kernel/security", fstype: "securityfs", flags: 0, data: ""},
-			mount{source: "debugfs", target: "/sys/kernel/debug", fstype: "debugfs", flags: 0, data: ""},
-			mount{source: "bpffs", target: "/sys/fs/bpf", fstype: "bpf", flags: 0, data: ""},
-		},
+		FinitModule:   finitModule[b.arch],
+		ConfigFile:    ConfigFile,
+		ConfigVersion: configVersion,
+		Generic:       generic,
+	}
+	if !generic {
+		config.ModuleErrorsFatal = b.moduleErrorsFatal
+		config.Environment = b.environment()
+		config.ArchiveNodes = b.archiveNodes()
 	}
 
 	tmpl, err := template.New("").Parse(initTemplate)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if err := tmpl.Execute(f, config); err != nil {
-		return err
+		return "", err
 	}
 
-	if err := f.Close(); err != nil {
+	return f.Name(), f.Close()
+}
+
+// buildScript is the name of the shell script written by DumpInit.
+const buildScript = "build.sh"
+
+// DumpInit writes the Go programs of init and bluebox-init, as they are compiled for the archive,
+// to dir without building them. If the archive gets the prebuilt init programs, these are the
+// generic programs, that read their configuration from ConfigFile. Along with the programs,
+// ConfigFile and a shell script with the go build commands and environment variables are written.
+func (b *Bluebox) DumpInit(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	generic := b.usePrebuilt()
+	initSrc, err := b.writeInit(dir, generic)
+	if err != nil {
+		return fmt.Errorf("failed to write init: %v", err)
+	}
+	blueboxSrc, err := b.writeBluebox(dir, generic)
+	if err != nil {
+		return fmt.Errorf("failed to write bluebox-init: %v", err)
+	}
+	if err := b.writeConfig(dir, generic); err != nil {
 		return err
 	}
 
-	cmd := exec.CommandContext(context.Background(), "go", "build", "-o", filepath.Join(dir, "init"),
-		f.Name())
+	// The prebuilt init programs are built reproducibly, see WritePrebuilt.
+	flags := buildFlags(b.reproducible || generic)
+	var script strings.Builder
+	script.WriteString("#!/bin/sh\n")
+	if generic {
+		script.WriteString("# Builds the prebuilt init programs of bluebox, that read their configuration from " +
+			ConfigFile + ".\n")
+	}
+	script.WriteString("set -e\ncd \"$(dirname \"$0\")\"\n")
+	for _, p := range []struct{ src, out string }{
+		{src: initSrc, out: "init"},
+		{src: blueboxSrc, out: "bluebox-init"},
+	} {
+		args := append(b.buildEnv(), "go", "build", "-o", p.out)
+		args = append(args, flags...)
+		args = append(args, filepath.Base(p.src))
+		for i, arg := range args {
+			args[i] = shellQuote(arg)
+		}
+		script.WriteString(strings.Join(args, " ") + "\n")
+	}
+	if err := os.WriteFile(filepath.Join(dir, buildScript), []byte(script.String()), 0o755); err != nil {
+		return fmt.Errorf("failed to write %s: %v", buildScript, err)
+	}
+	return nil
+}
 
-	cmd.Env = append(os.Environ(),
-		fmt.Sprintf("GOARCH=%s", b.arch),
-		"GOOS=linux",
-	)
+// shellQuote quotes s for the use in a shell script, if it contains special characters.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=./,:+") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
 
-	return cmd.Run()
+// environment returns the steps of init to prepare the system in the order they are done.
+func (b *Bluebox) environment() []environment {
+	var env []environment
+	for _, m := range b.mounts {
+		env = append(env, m)
+	}
+	for _, n := range b.nodes {
+		env = append(env, n)
+	}
+	for _, m := range b.modules {
+		env = append(env, m)
+	}
+	for _, l := range b.links {
+		env = append(env, l)
+	}
+	for _, r := range b.routes {
+		env = append(env, r)
+	}
+	return env
 }
 
 // createBluebox writes a Go program and compiles it. In a sequential order it will execute
-// the given execs with their respective args.
-func (b *Bluebox) createBluebox(tmpDir string) error {
-	f, err := os.OpenFile(filepath.Join(tmpDir, "bluebox.go"), os.O_CREATE|os.O_WRONLY, 0o600)
+// the given execs with their respective args. If generic is set, the program reads its
+// configuration from ConfigFile instead of having it built in.
+func (b *Bluebox) createBluebox(tmpDir string, generic bool) error {
+	src, err := b.writeBluebox(tmpDir, generic)
+	if err != nil {
+		return err
+	}
+	return b.build(src, filepath.Join(tmpDir, "bluebox-init"))
+}
+
+// cmdlineSource is the source of the parser of the kernel command line, that is part of
+// bluebox-init.
+//
+//go:embed internal/cmdline/cmdline.go
+var cmdlineSource string
+
+// cmdlineCode returns the declarations of cmdlineSource without its package clause and imports.
+func cmdlineCode() (string, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "cmdline.go", cmdlineSource, parser.ImportsOnly)
 	if err != nil {
-		return fmt.Errorf("failed to create temporary file: %v", err)
+		return "", err
+	}
+	// With ImportsOnly, the declarations only hold the imports.
+	end := f.Name.End()
+	if len(f.Decls) > 0 {
+		end = f.Decls[len(f.Decls)-1].End()
 	}
+	return strings.TrimSpace(cmdlineSource[fset.Position(end).Offset:]) + "\n", nil
+}
 
-	config := blueboxTemplateConfig{}
+// writeBluebox writes the Go program of bluebox-init to dir and returns its path.
+func (b *Bluebox) writeBluebox(dir string, generic bool) (string, error) {
+	f, err := os.OpenFile(filepath.Join(dir, "bluebox.go"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer f.Close()
 
-	for exe, arg := range b.execs {
-		config.Executables = append(config.Executables, filepath.Base(exe))
-		config.Arguments = append(config.Arguments, arg)
+	cmdline, err := cmdlineCode()
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the kernel command line parser: %v", err)
+	}
+	config := blueboxTemplateConfig{
+		ConfigFile:    ConfigFile,
+		ConfigVersion: configVersion,
+		Cmdline:       cmdline,
+		Generic:       generic,
 	}
+	if !generic {
+		config.DebugExitPort = b.debugExitPort
+		config.Events = b.events
+		config.Deadline = b.deadline
+		config.KillDelay = b.killDelay
+		config.StopOnTimeout = b.stopOnTimeout
+		config.ArtifactsDir = b.artifactsDir
+		config.ArtifactsDevice = b.artifactsDevice
+		config.CoverDir, config.SendCoverage = b.coverDir()
 
-	for _, env := range b.envVars {
-		config.EnvVars = append(config.EnvVars, envVar{
-			Key:   env.Key,
-			Value: env.Value,
-		})
+		for _, exe := range b.execs {
+			config.Executables = append(config.Executables, exe.dst)
+			config.Arguments = append(config.Arguments, exe.args)
+			config.Timeouts = append(config.Timeouts, exe.timeout)
+		}
+
+		for _, env := range b.envVars {
+			config.EnvVars = append(config.EnvVars, envVar{
+				Key:   env.Key,
+				Value: env.Value,
+			})
+		}
 	}
 
 	tmpl, err := template.New("").Parse(blueboxTemplate)
 	if err != nil {
-		return fmt.Errorf("failed to parse template: %v", err)
+		return "", fmt.Errorf("failed to parse template: %v", err)
 	}
 	if err := tmpl.Execute(f, config); err != nil {
-		return fmt.Errorf("failed to execute template: %v", err)
+		return "", fmt.Errorf("failed to execute template: %v", err)
 	}
 
 	if err := f.Close(); err != nil {
-		return fmt.Errorf("failed to close temporary file: %v", err)
+		return "", fmt.Errorf("failed to close temporary file: %v", err)
 	}
+	return f.Name(), nil
+}
 
+// build compiles the Go program src into a statically linked executable out for the configured
+// architecture. If the build cache is enabled, an executable built earlier from the same source
+// with the same toolchain is reused.
+func (b *Bluebox) build(src, out string) error {
 	path, err := exec.LookPath("go")
 	if err != nil {
 		return fmt.Errorf("failed to look up 'go' executable: %v", err)
 	}
 
-	cmd := exec.CommandContext(context.Background(), path, "build", "-o", filepath.Join(tmpDir, "bluebox-init"),
-		f.Name())
+	flags := buildFlags(b.reproducible)
+	env := append(os.Environ(), b.buildEnv()...)
+
+	var key string
+	if b.cacheDir != "" {
+		// The cache is an optimization, so builds continue without it on errors.
+		if key, err = cacheKey(path, env, flags, src); err == nil && cacheGet(b.cacheDir, key, out) {
+			return nil
+		}
+	}
+
+	args := append([]string{"build", "-o", out}, flags...)
+	args = append(args, src)
+	cmd := exec.CommandContext(context.Background(), path, args...)
+	cmd.Env = env
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, output)
+	}
+	if key != "" {
+		cachePut(b.cacheDir, key, out)
+	}
+	return nil
+}
 
-	cmd.Env = append(os.Environ(), fmt.Sprintf("GOARCH=%s", b.arch), "GOOS=linux")
+// buildFlags returns the flags of go build for the init programs.
+func buildFlags(reproducible bool) []string {
+	if !reproducible {
+		return nil
+	}
+	// Do not embed paths, VCS information and build IDs, that differ between builds.
+	return []string{"-trimpath", "-buildvcs=false", "-ldflags=-buildid="}
+}
 
-	return cmd.Run()
+// buildEnv returns the environment variables, that are set in addition to the environment of
+// bluebox, to compile the init programs for the configured architecture.
+func (b *Bluebox) buildEnv() []string {
+	return []string{
+		fmt.Sprintf("GOARCH=%s", b.arch),
+		"GOOS=linux",
+		"CGO_ENABLED=0",
+	}
 }
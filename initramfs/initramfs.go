@@ -5,10 +5,15 @@ package initramfs
 import (
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cavaliergopher/cpio"
 )
@@ -17,6 +22,46 @@ type envVar struct {
 	Key, Value string
 }
 
+// Step describes a single execution of an embedded executable.
+type Step struct {
+	// Executable is the path of the executable on the host.
+	Executable string
+	// Dest is the path of the executable inside the archive. By default the base name of
+	// Executable is used.
+	Dest string
+	// Args holds the arguments the executable is called with.
+	Args []string
+	// Timeout limits the run time of the executable. Once it expires, the process group of the
+	// executable is terminated. If zero, the run time is not limited.
+	Timeout time.Duration
+}
+
+// step describes an embedded executable and the arguments it is called with.
+type step struct {
+	// path of the executable on the host.
+	path string
+	// dst is the path of the executable inside the archive.
+	dst  string
+	args []string
+	// timeout limits the run time of the executable, if not zero.
+	timeout time.Duration
+}
+
+// embedding describes a file that is added to the archive but not executed.
+type embedding struct {
+	// src is the path of the file on the host.
+	src string
+	// dst is the path of the file inside the archive.
+	dst string
+	// mode holds type and permissions of directories and symbolic links. For regular files
+	// it is zero and type and permissions are taken from src.
+	mode fs.FileMode
+	// linkname holds the target of a symbolic link.
+	linkname string
+	// major and minor hold the device number of a device node.
+	major, minor uint32
+}
+
 type Bluebox struct {
 	// arch holds the GOARCH value used when compiling the init.
 	arch string
@@ -24,63 +69,171 @@ type Bluebox struct {
 	// enVars holds a list of environment variables.
 	envVars []envVar
 
-	// execs maps executables to their arguments.
-	execs map[string][]string
+	// execs holds the executables in the order they will be executed.
+	execs []step
+
+	// embeddings holds a list of files that will be added additionallity into the resulting arichve.
+	embeddings []embedding
+
+	// mounts holds the file systems, that are mounted by the generated init in this order.
+	mounts []Mount
+
+	// nodes holds the device nodes, that are created by the generated init once all file
+	// systems are mounted.
+	nodes []nod
+
+	// modules holds the kernel modules in the order they are loaded by the generated init.
+	modules []module
+
+	// moduleErrorsFatal stops the generated init, if a kernel module can not be loaded.
+	moduleErrorsFatal bool
+
+	// links holds the network interfaces, that are configured by the generated init.
+	links []Link
+
+	// routes holds the routes, that are added by the generated init.
+	routes []Route
+
+	// compressor compresses the resulting archive. If nil, the archive is not compressed.
+	compressor Compressor
+
+	// reproducible enables the generation of byte-identical archives for the same input.
+	reproducible bool
+
+	// debugExitPort is the I/O port of the QEMU isa-debug-exit device, that receives the result.
+	debugExitPort uint16
+
+	// events enables the structured output of bluebox-init.
+	events bool
+
+	// deadline limits the run time of all executables, if not zero.
+	deadline time.Duration
+
+	// killDelay is the time between SIGTERM and SIGKILL, once a timeout expired.
+	killDelay time.Duration
+
+	// stopOnTimeout skips the remaining executables, once the timeout of an executable expired.
+	stopOnTimeout bool
+
+	// artifactsDir is the directory in the guest, that is written to artifactsDevice once all
+	// executables finished. If empty, no artifacts are collected.
+	artifactsDir string
+
+	// artifactsDevice is the raw block device in the guest, that receives the artifacts.
+	artifactsDevice string
+
+	// coverage sets GOCOVERDIR for the executables and collects the written coverage data.
+	coverage bool
+
+	// cacheDir is the directory of the build cache for the init programs. If empty, the init
+	// programs are always compiled.
+	cacheDir string
 
-	// embeddings maps a list of files that will be added additionallity into the resulting arichve.
-	embeddings map[string]bool
+	// noPrebuilt always compiles the init programs instead of using the prebuilt ones.
+	noPrebuilt bool
 }
 
 // New constructs Bluebox with default values.
 func New() *Bluebox {
-	return &Bluebox{
-		arch:       runtime.GOARCH,
-		execs:      make(map[string][]string),
-		embeddings: make(map[string]bool),
+	b := &Bluebox{
+		arch:      runtime.GOARCH,
+		killDelay: 5 * time.Second,
 	}
+	if dir, err := DefaultCacheDir(); err == nil {
+		b.cacheDir = dir
+	}
+	for _, name := range defaultMounts {
+		b.mounts = append(b.mounts, standardMounts[name])
+	}
+	b.nodes = append(b.nodes, defaultNodes...)
+	return b
 }
 
 // Execute embeds executable into the resulting archive and passes arg as arguments to
-// its execution instruction.
+// its execution instruction. Executables are run in the order they were added.
+// The same executable can be added multiple times with different arguments. It is
+// stored only once in the archive but executed for every call.
 func (b *Bluebox) Execute(executable string, args ...string) error {
-	if executable == "init" || executable == "bluebox" || executable == "bluebox-init" {
-		return fmt.Errorf("embedded executable should not be named '%s'", executable)
-	}
+	return b.ExecuteAs(executable, filepath.Base(executable), args...)
+}
 
-	// TODO: Validate if and how executing the same executable is possible.
-	if _, ok := b.execs[executable]; ok {
-		return fmt.Errorf("%s is already embedded. Can not add it multiple times", executable)
+// ExecuteAs works like Execute but places executable at dst inside the archive.
+// Parent directories of dst are created in the archive as needed.
+func (b *Bluebox) ExecuteAs(executable, dst string, args ...string) error {
+	return b.AddStep(Step{
+		Executable: executable,
+		Dest:       dst,
+		Args:       args,
+	})
+}
+
+// AddStep embeds the executable of s into the resulting archive and adds its execution. Like
+// Execute, steps are run in the order they were added.
+func (b *Bluebox) AddStep(s Step) error {
+	executable := s.Executable
+	dst := s.Dest
+	if dst == "" {
+		dst = filepath.Base(executable)
+	}
+	dst, err := archivePath(dst)
+	if err != nil {
+		return err
+	}
+	if s.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %v for %s", s.Timeout, executable)
 	}
 
 	// Cross check with read-only files.
-	if _, ok := b.embeddings[executable]; ok {
+	if b.isEmbedded(executable) {
 		return fmt.Errorf("%s is already embedded. Can not add it multiple times", executable)
 	}
+	if src, ok := b.source(dst); ok && src != executable {
+		return fmt.Errorf("%s is already used by %s", dst, src)
+	}
 
 	// Verify name references a file.
-	s, err := os.Stat(executable)
+	fi, err := os.Stat(executable)
 	if err != nil {
 		return err
 	}
-	if s.IsDir() {
+	if fi.IsDir() {
 		return fmt.Errorf("%s should not be a directory", executable)
 	}
 
-	b.execs[executable] = append([]string{}, args...)
+	b.execs = append(b.execs, step{
+		path:    executable,
+		dst:     dst,
+		args:    append([]string{}, s.Args...),
+		timeout: s.Timeout,
+	})
 
 	return nil
 }
 
 // Embed adds file into the resulting archive but does not add it for execution by the init program.
 func (b *Bluebox) Embed(file string) error {
-	if _, ok := b.embeddings[file]; ok {
+	return b.EmbedAs(file, filepath.Base(file))
+}
+
+// EmbedAs works like Embed but places file at dst inside the archive. Parent directories of
+// dst are created in the archive as needed.
+func (b *Bluebox) EmbedAs(file, dst string) error {
+	dst, err := archivePath(dst)
+	if err != nil {
+		return err
+	}
+
+	if b.isEmbedded(file) {
 		return fmt.Errorf("%s is already embedded. Can not add it multiple times", file)
 	}
 
 	// Cross check with executable files.
-	if _, ok := b.execs[file]; ok {
+	if b.isExecutable(file) {
 		return fmt.Errorf("%s is already embedded. Can not add it multiple times", file)
 	}
+	if src, ok := b.source(dst); ok {
+		return fmt.Errorf("%s is already used by %s", dst, src)
+	}
 
 	// Verify name references a file.
 	s, err := os.Stat(file)
@@ -91,11 +244,216 @@ func (b *Bluebox) Embed(file string) error {
 		return fmt.Errorf("%s should not be a directory", file)
 	}
 
-	b.embeddings[file] = true
+	b.embeddings = append(b.embeddings, embedding{
+		src: file,
+		dst: dst,
+	})
 
 	return nil
 }
 
+// EmbedDir adds the directory tree dir recursively at dst into the resulting archive. Paths
+// relative to dir, file modes, symbolic links and empty directories are kept. If dst is "." the
+// content of dir is placed into the root of the archive.
+//
+// If include is not empty, only files and symbolic links that match at least one of the
+// patterns are added together with their parent directories. Files, symbolic links and directories that match a pattern of exclude
+// are skipped. Patterns use the syntax of path.Match and are matched against the path relative
+// to dir as well as the base name.
+func (b *Bluebox) EmbedDir(dir, dst string, include, exclude []string) error {
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+		}
+	}
+
+	prefix := ""
+	if path.Clean(filepath.ToSlash(dst)) != "." {
+		var err error
+		if prefix, err = archivePath(dst); err != nil {
+			return err
+		}
+	}
+
+	s, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !s.IsDir() {
+		return fmt.Errorf("%s should be a directory", dir)
+	}
+
+	var embeddings []embedding
+	err = filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if rel != "." && matchAny(exclude, rel) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		name := path.Join(prefix, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			if name == "" {
+				// The root of the archive is provided by the kernel.
+				return nil
+			}
+			if name != prefix {
+				if _, err := archivePath(name); err != nil {
+					return err
+				}
+			}
+			embeddings = append(embeddings, embedding{
+				src:  file,
+				dst:  name,
+				mode: info.Mode(),
+			})
+			return nil
+		case len(include) != 0 && !matchAny(include, rel):
+			return nil
+		}
+
+		if _, err := archivePath(name); err != nil {
+			return err
+		}
+		if b.isEmbedded(file) || b.isExecutable(file) {
+			return fmt.Errorf("%s is already embedded. Can not add it multiple times", file)
+		}
+		if src, ok := b.source(name); ok {
+			return fmt.Errorf("%s is already used by %s", name, src)
+		}
+
+		switch {
+		case info.Mode().IsRegular():
+			embeddings = append(embeddings, embedding{
+				src: file,
+				dst: name,
+			})
+		case info.Mode()&fs.ModeSymlink != 0:
+			linkname, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			embeddings = append(embeddings, embedding{
+				src:      file,
+				dst:      name,
+				mode:     info.Mode(),
+				linkname: filepath.ToSlash(linkname),
+			})
+		default:
+			return fmt.Errorf("%s has unsupported file type %s", file, info.Mode().Type())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(include) != 0 {
+		embeddings = matchedDirs(embeddings)
+	}
+
+	b.embeddings = append(b.embeddings, embeddings...)
+	return nil
+}
+
+// matchedDirs removes the directories from embeddings, that contain no files or symbolic links.
+func matchedDirs(embeddings []embedding) []embedding {
+	parents := make(map[string]bool)
+	for _, e := range embeddings {
+		if e.mode.IsDir() {
+			continue
+		}
+		for dir := path.Dir(e.dst); dir != "."; dir = path.Dir(dir) {
+			parents[dir] = true
+		}
+	}
+	return slices.DeleteFunc(embeddings, func(e embedding) bool {
+		return e.mode.IsDir() && !parents[e.dst]
+	})
+}
+
+// matchAny reports whether name or its base name matches any of patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// archivePath validates dst and returns it in the form it is written to the archive.
+func archivePath(dst string) (string, error) {
+	name := path.Clean(strings.TrimLeft(filepath.ToSlash(dst), "/"))
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("'%s' is not a valid destination in the archive", dst)
+	}
+	if name == "init" || name == "bluebox-init" || name == ConfigFile {
+		return "", fmt.Errorf("embedded file should not be named '%s'", name)
+	}
+
+	// /bluebox becomes the new root file system and /dev is provided by the kernel. Files
+	// below these directories are not available to the executables.
+	switch top, _, _ := strings.Cut(name, "/"); top {
+	case "bluebox", "dev":
+		return "", fmt.Errorf("embedded file should not be placed in '/%s'", top)
+	}
+	return name, nil
+}
+
+// isExecutable reports whether file was already added with Execute.
+func (b *Bluebox) isExecutable(file string) bool {
+	for _, exe := range b.execs {
+		if exe.path == file {
+			return true
+		}
+	}
+	return false
+}
+
+// isEmbedded reports whether file was already added with Embed.
+func (b *Bluebox) isEmbedded(file string) bool {
+	for _, embedding := range b.embeddings {
+		if embedding.src == file {
+			return true
+		}
+	}
+	return false
+}
+
+// source returns the file on the host that is placed at dst inside the archive.
+func (b *Bluebox) source(dst string) (string, bool) {
+	for _, exe := range b.execs {
+		if exe.dst == dst {
+			return exe.path, true
+		}
+	}
+	for _, embedding := range b.embeddings {
+		if embedding.dst == dst && !embedding.mode.IsDir() {
+			return embedding.src, true
+		}
+	}
+	return "", false
+}
+
 // Setarch sets the architecture for the generated initramfs archive. If the architecture is not
 // part of GOARCH an error will be returned. By default the architecture of the host is used.
 func (b *Bluebox) Setarch(arch string) error {
@@ -109,6 +467,94 @@ func (b *Bluebox) Setarch(arch string) error {
 	return nil
 }
 
+// SetCompressor sets the Compressor that is used to compress the generated initramfs archive.
+// If c is nil, the archive is not compressed. By default the archive is not compressed.
+func (b *Bluebox) SetCompressor(c Compressor) {
+	b.compressor = c
+}
+
+// SetReproducible enables or disables the generation of reproducible archives. If enabled, the
+// same configuration results in byte-identical archives. The entries of the archive are sorted,
+// their modification time is taken from the environment variable SOURCE_DATE_EPOCH, or the Unix
+// epoch if it is not set, and the init programs are built without paths and build IDs of the
+// host.
+func (b *Bluebox) SetReproducible(reproducible bool) {
+	b.reproducible = reproducible
+}
+
+// SetDebugExit configures bluebox-init to report the aggregated result of all executables to the
+// QEMU isa-debug-exit device at the given I/O port, e.g. 0xf4. QEMU then exits with the status
+// (result << 1) | 1. This is only supported on amd64 and 386. If port is zero, which is the
+// default, the result is only printed to the console. See ParseResult.
+func (b *Bluebox) SetDebugExit(port uint16) {
+	b.debugExitPort = port
+}
+
+// SetEventStream enables or disables the structured output of bluebox-init. If enabled,
+// bluebox-init writes framed JSON events for the start, the output and the exit of every executable
+// as well as the shut down to the console instead of human readable lines. The events can be
+// decoded with the package github.com/florianl/bluebox/event.
+func (b *Bluebox) SetEventStream(enabled bool) {
+	b.events = enabled
+}
+
+// SetDeadline limits the run time of all executables to d. Once it expires, the running
+// executable is terminated like on the expiry of its own timeout, the remaining executables are
+// skipped and the virtual machine is shut down. If d is zero, which is the default, the run time
+// is not limited.
+func (b *Bluebox) SetDeadline(d time.Duration) {
+	b.deadline = d
+}
+
+// SetKillDelay sets the time between sending SIGTERM and SIGKILL to the process group of an
+// executable, once its timeout expired. By default SIGKILL is sent 5 seconds after SIGTERM.
+func (b *Bluebox) SetKillDelay(d time.Duration) {
+	b.killDelay = d
+}
+
+// SetStopOnTimeout configures whether the remaining executables are skipped, once the timeout of
+// an executable expired. By default the remaining executables are run.
+func (b *Bluebox) SetStopOnTimeout(stop bool) {
+	b.stopOnTimeout = stop
+}
+
+// SetArtifacts configures bluebox-init to collect the files the executables write to the
+// directory dir in the guest. dir is created before the first executable is run and its path is
+// available to the executables in the environment variable BLUEBOX_ARTIFACTS. Once all
+// executables finished, the regular files and directories below dir are written as tar stream to
+// the raw block device, e.g. /dev/vdb, right before the virtual machine is shut down. No file
+// system driver is needed for the device and the host side can unpack the stream with the package
+// github.com/florianl/bluebox/artifact. If dir is empty, no artifacts are collected, which is the
+// default.
+func (b *Bluebox) SetArtifacts(dir, device string) error {
+	if dir == "" {
+		b.artifactsDir, b.artifactsDevice = "", ""
+		return nil
+	}
+	if !path.IsAbs(dir) {
+		return fmt.Errorf("artifacts directory %s is not an absolute path", dir)
+	}
+	if dir = path.Clean(dir); dir == "/" {
+		return fmt.Errorf("can not collect / as artifacts")
+	}
+	if !path.IsAbs(device) {
+		return fmt.Errorf("artifacts device %s is not an absolute path", device)
+	}
+	b.artifactsDir, b.artifactsDevice = dir, path.Clean(device)
+	return nil
+}
+
+// SetCoverage configures bluebox-init to collect the coverage data of executables, that were built
+// with -cover. GOCOVERDIR is set for every executable and once all executables finished, the
+// written counter and meta-data files are collected. If artifacts are collected with
+// SetArtifacts, the files are written to the subdirectory coverage of the artifacts directory.
+// Otherwise they are written as file events to the console, which can be extracted with
+// ExtractFiles of the package github.com/florianl/bluebox/event. On the host, the files can be
+// processed with go tool covdata. By default no coverage data is collected.
+func (b *Bluebox) SetCoverage(enabled bool) {
+	b.coverage = enabled
+}
+
 // Setenv sets the value of the environment variable named by the key.
 func (b *Bluebox) Setenv(key, value string) {
 	b.envVars = append(b.envVars,
@@ -122,53 +568,190 @@ func (b *Bluebox) Setenv(key, value string) {
 // To do so it first auto generates a init program from the given parameters and compiles it before
 // placing it into archive.
 func (b *Bluebox) Generate(archive io.Writer) error {
+	if b.debugExitPort != 0 && b.arch != "amd64" && b.arch != "386" {
+		return fmt.Errorf("isa-debug-exit is not supported on %s", b.arch)
+	}
+	if _, ok := finitModule[b.arch]; len(b.modules) != 0 && !ok {
+		return fmt.Errorf("loading kernel modules is not supported on %s", b.arch)
+	}
+
 	tmpDir, err := os.MkdirTemp("", "bluebox-")
 	if err != nil {
 		return fmt.Errorf("failed to create temporary directory: %v", err)
 	}
 	defer os.RemoveAll(tmpDir)
 
-	// Generate the init executable that is called by the kernel and prepares the system for
-	// further use.
-	if err := b.createInit(tmpDir); err != nil {
-		return fmt.Errorf("failed to create the initial executable: %v", err)
+	if err := checkConflicts(b.entries(tmpDir)); err != nil {
+		return err
+	}
+
+	generic, err := b.copyPrebuilt(tmpDir)
+	if err != nil {
+		return err
+	}
+	if !generic {
+		// Generate the init executable that is called by the kernel and prepares the system
+		// for further use.
+		if err := b.createInit(tmpDir, false); err != nil {
+			return fmt.Errorf("failed to create the initial executable: %v", err)
+		}
+
+		// Generate bluebox-init which will call the given executables in a sequential order.
+		if err := b.createBluebox(tmpDir, false); err != nil {
+			return fmt.Errorf("failed to generate bluebox-init: %v", err)
+		}
+	}
+	if err := b.writeConfig(tmpDir, generic); err != nil {
+		return err
 	}
 
-	// Generate bluebox-init which will call the given executables in a sequential order.
-	if err := b.createBluebox(tmpDir); err != nil {
-		return fmt.Errorf("failed to generate bluebox-init: %v", err)
+	if b.compressor == nil {
+		return b.writeArchive(archive, tmpDir)
 	}
 
-	w := cpio.NewWriter(archive)
-	defer w.Close()
+	cw, err := b.compressor.NewWriter(archive)
+	if err != nil {
+		return fmt.Errorf("failed to create compressor: %v", err)
+	}
+	if err := b.writeArchive(cw, tmpDir); err != nil {
+		cw.Close()
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return fmt.Errorf("failed to compress archive: %v", err)
+	}
+	return nil
+}
+
+// writeArchive writes the cpio archive with the init programs from tmpDir and all embedded files
+// to archive.
+func (b *Bluebox) writeArchive(archive io.Writer, tmpDir string) error {
+	modTime, err := b.modTime()
+	if err != nil {
+		return err
+	}
+
+	entries := b.entries(tmpDir)
+	if b.reproducible {
+		// Parent directories always sort before their content.
+		slices.SortStableFunc(entries, func(a, b embedding) int {
+			return strings.Compare(a.dst, b.dst)
+		})
+	}
+
+	w := &newcWriter{w: archive}
+	for _, e := range entries {
+		hdr := &newcHeader{
+			name:    e.dst,
+			modTime: modTime,
+		}
+
+		var err error
+		switch {
+		case e.mode.IsDir():
+			hdr.mode = cpio.TypeDir | cpioPerm(e.mode)
+			err = w.add(hdr, nil)
+		case e.mode&fs.ModeSymlink != 0:
+			err = addSymlink(w, hdr, e.linkname)
+		case e.mode&fs.ModeDevice != 0:
+			err = addDevice(w, hdr, e.mode, e.major, e.minor)
+		default:
+			err = addFile(w, hdr, e.src)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to add '%s': %v", e.src, err)
+		}
+	}
 
-	// Add init to archive.
-	if err := addFile(w, filepath.Join(tmpDir, "init")); err != nil {
-		return fmt.Errorf("failed to add init file: %v", err)
+	if err := w.close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %v", err)
 	}
+	return nil
+}
 
-	// Add bluebox-init to archive.
-	if err := addFile(w, filepath.Join(tmpDir, "bluebox-init")); err != nil {
-		return fmt.Errorf("failed to add bluebox-init file: %v", err)
+// entries returns all entries of the archive in the order they are added by default. This
+// includes the init programs from tmpDir and parent directories of the embedded files.
+func (b *Bluebox) entries(tmpDir string) []embedding {
+	entries := []embedding{
+		{src: filepath.Join(tmpDir, "init"), dst: "init"},
+		{src: filepath.Join(tmpDir, "bluebox-init"), dst: "bluebox-init"},
+		{src: filepath.Join(tmpDir, ConfigFile), dst: ConfigFile},
 	}
 
-	for file := range b.execs {
-		if err := addFile(w, file); err != nil {
-			return fmt.Errorf("failed to add file '%s': %v", file, err)
+	dirs := make(map[string]bool)
+	added := make(map[string]bool)
+	for _, exe := range b.execs {
+		if added[exe.dst] {
+			// Executables that run multiple times are added only once.
+			continue
 		}
+		entries = addDirs(entries, dirs, exe.dst)
+		entries = append(entries, embedding{src: exe.path, dst: exe.dst})
+		added[exe.dst] = true
 	}
 
-	for file := range b.embeddings {
-		if err := addFile(w, file); err != nil {
-			return fmt.Errorf("failed to embed '%s': %v", file, err)
+	for _, file := range b.embeddings {
+		if file.mode.IsDir() {
+			if dirs[file.dst] {
+				continue
+			}
+			dirs[file.dst] = true
 		}
+		entries = addDirs(entries, dirs, file.dst)
+		entries = append(entries, file)
 	}
+	return entries
+}
 
+// checkConflicts returns an error, if a path is used for a file and a directory, as the Linux
+// kernel can not unpack such an archive. As entries contains the parent directories of all
+// files, this includes files placed below other files.
+func checkConflicts(entries []embedding) error {
+	dirs := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		if isDir, ok := dirs[e.dst]; ok && isDir != e.mode.IsDir() {
+			return fmt.Errorf("'%s' is used as file and as directory in the archive", e.dst)
+		}
+		dirs[e.dst] = e.mode.IsDir()
+	}
 	return nil
 }
 
-// addFile adds file to the cpio archive.
-func addFile(w *cpio.Writer, file string) error {
+// modTime returns the modification time for the entries of the archive. For reproducible archives
+// it is taken from SOURCE_DATE_EPOCH and defaults to the Unix epoch.
+func (b *Bluebox) modTime() (time.Time, error) {
+	if !b.reproducible {
+		return time.Time{}, nil
+	}
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return time.Unix(0, 0), nil
+	}
+	sec, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH '%s': %v", epoch, err)
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// addDirs appends all parent directories of name to entries, that are not yet part of dirs.
+func addDirs(entries []embedding, dirs map[string]bool, name string) []embedding {
+	dir := path.Dir(name)
+	if dir == "." || dirs[dir] {
+		return entries
+	}
+	entries = addDirs(entries, dirs, dir)
+	dirs[dir] = true
+	return append(entries, embedding{
+		src:  dir,
+		dst:  dir,
+		mode: fs.ModeDir | 0o755,
+	})
+}
+
+// addFile adds file with the given header to the cpio archive. Size and permissions of hdr are
+// taken from file.
+func addFile(w *newcWriter, hdr *newcHeader, file string) error {
 	f, err := os.Open(file)
 	if err != nil {
 		return err
@@ -178,15 +761,29 @@ func addFile(w *cpio.Writer, file string) error {
 	if err != nil {
 		return err
 	}
-	if err := w.WriteHeader(&cpio.Header{
-		Name: filepath.Base(file),
-		Mode: cpio.FileMode(fi.Mode().Perm()),
-		Size: fi.Size(),
-	}); err != nil {
-		return err
+	hdr.mode = cpio.TypeReg | cpioPerm(fi.Mode())
+	hdr.size = fi.Size()
+	return w.add(hdr, f)
+}
+
+// addSymlink adds a symbolic link with the given header pointing to linkname to the cpio archive.
+func addSymlink(w *newcWriter, hdr *newcHeader, linkname string) error {
+	hdr.mode = cpio.TypeSymlink | 0o777
+	hdr.size = int64(len(linkname))
+	return w.add(hdr, strings.NewReader(linkname))
+}
+
+// cpioPerm converts the permission bits of mode into their cpio representation.
+func cpioPerm(mode fs.FileMode) cpio.FileMode {
+	perm := cpio.FileMode(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		perm |= cpio.ModeSetuid
 	}
-	if _, err := io.Copy(w, f); err != nil {
-		return err
+	if mode&fs.ModeSetgid != 0 {
+		perm |= cpio.ModeSetgid
+	}
+	if mode&fs.ModeSticky != 0 {
+		perm |= cpio.ModeSticky
 	}
-	return w.Flush()
+	return perm
 }
@@ -1,13 +1,1250 @@
 package initramfs
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/cavaliergopher/cpio"
+	exec "golang.org/x/sys/execabs"
 )
 
+func TestMain(m *testing.M) {
+	// Keep the tests out of the build cache of the user. Without a user cache directory, the
+	// build cache is disabled, unless a test sets its own directory with SetCacheDir.
+	userCacheDir = func() (string, error) {
+		return "", errors.New("no user cache directory in tests")
+	}
+	os.Exit(m.Run())
+}
+
 func TestBluebox(t *testing.T) {
 	b := New()
 	if err := b.Generate(io.Discard); err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestEventStream(t *testing.T) {
+	b := New()
+	b.SetEventStream(true)
+	if err := b.Generate(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testExecutable returns the path of a file named pkg.test, that can be added as executable.
+func testExecutable(t *testing.T) string {
+	t.Helper()
+	exe := filepath.Join(t.TempDir(), "pkg.test")
+	if err := os.WriteFile(exe, []byte("pkg.test"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return exe
+}
+
+// archiveNames returns the names of all entries in the cpio archive in the order they were written.
+func archiveNames(t *testing.T, archive io.Reader) []string {
+	t.Helper()
+	var names []string
+	r := cpio.NewReader(archive)
+	for {
+		hdr, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+func TestExecuteOrder(t *testing.T) {
+	dir := t.TempDir()
+	order := []string{"charlie", "alpha", "bravo"}
+
+	b := New()
+	for _, name := range order {
+		exe := filepath.Join(dir, name)
+		if err := os.WriteFile(exe, []byte(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Execute(exe, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var archive bytes.Buffer
+	if err := b.Generate(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := append([]string{"init", "bluebox-init", "bluebox.json"}, order...)
+	if names := archiveNames(t, &archive); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("archive entries did not match. Got: %#v\nExpected: %#v", names, expected)
+	}
+}
+
+func TestExecuteMultipleTimes(t *testing.T) {
+	exe := testExecutable(t)
+	b := New()
+	if err := b.Execute(exe, "-test.run=Foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Execute(exe, "-test.run=Bar", "-test.count=3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Embed(exe); err == nil {
+		t.Fatal("expected an error when embedding an executable as read-only file")
+	}
+
+	expected := []step{
+		{path: exe, dst: "pkg.test", args: []string{"-test.run=Foo"}},
+		{path: exe, dst: "pkg.test", args: []string{"-test.run=Bar", "-test.count=3"}},
+	}
+	if !reflect.DeepEqual(b.execs, expected) {
+		t.Fatalf("steps did not match. Got: %#v\nExpected: %#v", b.execs, expected)
+	}
+
+	var archive bytes.Buffer
+	if err := b.Generate(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedNames := []string{"init", "bluebox-init", "bluebox.json", "pkg.test"}
+	if names := archiveNames(t, &archive); !reflect.DeepEqual(names, expectedNames) {
+		t.Fatalf("archive entries did not match. Got: %#v\nExpected: %#v", names, expectedNames)
+	}
+}
+
+func TestEmbedAs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name, "x.json"), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := New()
+	if err := b.EmbedAs(filepath.Join(dir, "a", "x.json"), "testdata/a/x.json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.EmbedAs(filepath.Join(dir, "b", "x.json"), "/testdata/b/x.json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Embed(filepath.Join(dir, "b", "x.json")); err == nil {
+		t.Fatal("expected an error when embedding the same file twice")
+	}
+
+	for _, dst := range []string{"testdata/a/x.json", "", "/", "../x.json", "init", "dev/x.json", "bluebox/x.json"} {
+		if err := b.ExecuteAs(filepath.Join(dir, "a", "x.json"), dst); err == nil {
+			t.Fatalf("expected an error for destination '%s'", dst)
+		}
+	}
+
+	var archive bytes.Buffer
+	if err := b.Generate(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"init", "bluebox-init", "bluebox.json",
+		"testdata", "testdata/a", "testdata/a/x.json",
+		"testdata/b", "testdata/b/x.json",
+	}
+	if names := archiveNames(t, &archive); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("archive entries did not match. Got: %#v\nExpected: %#v", names, expected)
+	}
+}
+
+func TestEmbedConflict(t *testing.T) {
+	dir := t.TempDir()
+	for name, dsts := range map[string][]string{
+		"file below file":          {"a", "a/b"},
+		"file below init":          {"init/x"},
+		"file below configuration": {"bluebox.json/x"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := New()
+			for i, dst := range dsts {
+				file := filepath.Join(dir, strconv.Itoa(i))
+				if err := os.WriteFile(file, []byte(dst), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				if err := b.EmbedAs(file, dst); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := b.Generate(io.Discard); err == nil || !strings.Contains(err.Error(), "file and as directory") {
+				t.Fatalf("expected a conflict for embedding %q, got %v", dsts, err)
+			}
+		})
+	}
+}
+
+func TestEmbedDir(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"a/b", "c", "empty", "skip"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"a/x.json", "a/b/y.json", "a/b/y.txt", "c/z.txt", "skip/z.json"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte(f), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("b/y.json", filepath.Join(dir, "a", "link.json")); err != nil {
+		t.Skipf("symbolic links are not supported: %v", err)
+	}
+
+	b := New()
+	if err := b.EmbedDir(dir, "testdata", []string{"*.json"}, []string{"skip"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.EmbedDir(dir, "testdata", nil, nil); err == nil {
+		t.Fatal("expected an error when embedding the same directory twice")
+	}
+	if err := b.EmbedDir(dir, "other", []string{"[-"}, nil); err == nil {
+		t.Fatal("expected an error for an invalid pattern")
+	}
+	// Without include, empty directories are kept.
+	other := t.TempDir()
+	if err := os.Mkdir(filepath.Join(other, "empty"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.EmbedDir(other, "other", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err := b.Generate(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		mode     cpio.FileMode
+		linkname string
+	}
+	expected := map[string]entry{
+		"init":                 {mode: cpio.TypeReg},
+		"bluebox-init":         {mode: cpio.TypeReg},
+		"bluebox.json":         {mode: cpio.TypeReg},
+		"testdata":             {mode: cpio.TypeDir},
+		"testdata/a":           {mode: cpio.TypeDir},
+		"testdata/a/b":         {mode: cpio.TypeDir},
+		"testdata/a/b/y.json":  {mode: cpio.TypeReg},
+		"testdata/a/link.json": {mode: cpio.TypeSymlink, linkname: "b/y.json"},
+		"testdata/a/x.json":    {mode: cpio.TypeReg},
+		"other":                {mode: cpio.TypeDir},
+		"other/empty":          {mode: cpio.TypeDir},
+	}
+	entries := make(map[string]entry)
+	r := cpio.NewReader(&archive)
+	for {
+		hdr, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[hdr.Name] = entry{mode: hdr.Mode &^ cpio.ModePerm, linkname: hdr.Linkname}
+		if hdr.Name == "testdata/a/x.json" && runtime.GOOS != "windows" && hdr.Mode.Perm() != 0o640 {
+			t.Fatalf("expected permissions 0640 but got %v", hdr.Mode.Perm())
+		}
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("archive entries did not match. Got: %#v\nExpected: %#v", entries, expected)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	tests := map[string]struct {
+		compression string
+		decompress  func(io.Reader) (io.Reader, error)
+	}{
+		"none": {
+			compression: "none",
+			decompress: func(r io.Reader) (io.Reader, error) {
+				return r, nil
+			},
+		},
+		"gzip": {
+			compression: "gzip",
+			decompress: func(r io.Reader) (io.Reader, error) {
+				return gzip.NewReader(r)
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			c, err := CompressorByName(tc.compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b := New()
+			b.SetCompressor(c)
+
+			var archive bytes.Buffer
+			if err := b.Generate(&archive); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := tc.decompress(&archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []string{"init", "bluebox-init", "bluebox.json"}
+			if names := archiveNames(t, r); !reflect.DeepEqual(names, expected) {
+				t.Fatalf("archive entries did not match. Got: %#v\nExpected: %#v", names, expected)
+			}
+		})
+	}
+
+	if _, err := CompressorByName("bzip3"); err == nil {
+		t.Fatal("expected an error for an unknown compression")
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+
+	dir := t.TempDir()
+	for _, name := range []string{"b", "a"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	generate := func() []byte {
+		b := New()
+		// Both archives need to be compiled, so neither the prebuilt init programs nor the
+		// cache must be used.
+		b.SetPrebuilt(false)
+		b.SetCacheDir("")
+		b.SetReproducible(true)
+		if err := b.Execute(filepath.Join(dir, "b")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.EmbedAs(filepath.Join(dir, "a"), "data/a"); err != nil {
+			t.Fatal(err)
+		}
+		var archive bytes.Buffer
+		if err := b.Generate(&archive); err != nil {
+			t.Fatal(err)
+		}
+		return archive.Bytes()
+	}
+
+	first := generate()
+	if second := generate(); !bytes.Equal(first, second) {
+		t.Fatal("expected identical archives")
+	}
+
+	expected := []string{"b", "bluebox-init", "bluebox.json", "data", "data/a", "init"}
+	var names []string
+	r := cpio.NewReader(bytes.NewReader(first))
+	for {
+		hdr, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.ModTime.Unix() != 1700000000 {
+			t.Fatalf("expected modification time from SOURCE_DATE_EPOCH but got %v", hdr.ModTime)
+		}
+		names = append(names, hdr.Name)
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("archive entries did not match. Got: %#v\nExpected: %#v", names, expected)
+	}
+}
+
+func TestParseResult(t *testing.T) {
+	tests := map[string]struct {
+		line   string
+		result Result
+		ok     bool
+	}{
+		"no result": {
+			line: "[            ] stdout: PASS",
+		},
+		"passed": {
+			line:   "[            ] bluebox-result: steps=2 passed=2 failed=0 exit=0",
+			result: Result{Steps: 2, Passed: 2},
+			ok:     true,
+		},
+		"failed": {
+			line:   "[            ] bluebox-result: steps=3 passed=1 failed=2 exit=1\r",
+			result: Result{Steps: 3, Passed: 1, Failed: 2, Exit: 1},
+			ok:     true,
+		},
+		"kernel output in front": {
+			line: "[    1.337] random: crng init done[            ] bluebox-result: steps=3 passed=1 failed=2 exit=1",
+		},
+		"spoofed by stdout": {
+			line: "[            ] stdout: [            ] bluebox-result: steps=1 passed=1 failed=0 exit=0",
+		},
+		"truncated": {
+			line: "[            ] bluebox-result: steps=3 passed=1",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, ok := ParseResult(tc.line)
+			if ok != tc.ok {
+				t.Fatalf("expected %v but got %v", tc.ok, ok)
+			}
+			if result != tc.result {
+				t.Fatalf("results did not match. Got: %#v\nExpected: %#v", result, tc.result)
+			}
+		})
+	}
+}
+
+func TestDebugExit(t *testing.T) {
+	b := New()
+	b.SetDebugExit(0xf4)
+	if err := b.Setarch("arm64"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Generate(io.Discard); err == nil {
+		t.Fatal("expected an error for isa-debug-exit on arm64")
+	}
+	if err := b.Setarch("amd64"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Generate(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	exe := testExecutable(t)
+	b := New()
+	if err := b.AddStep(Step{Executable: exe, Timeout: -time.Second}); err == nil {
+		t.Fatal("expected an error for a negative timeout")
+	}
+	if err := b.AddStep(Step{Executable: exe, Timeout: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddStep(Step{Executable: exe, Args: []string{"-test.run=Foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	b.SetDeadline(10 * time.Minute)
+	b.SetKillDelay(time.Second)
+	b.SetStopOnTimeout(true)
+	if err := b.Generate(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMounts(t *testing.T) {
+	b := New()
+	if err := b.RemoveMount("/sys/kernel/debug"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RemoveMount("/sys/kernel/debug"); err == nil {
+		t.Fatal("expected an error for removing a missing mount")
+	}
+	if err := b.AddMount(Mount{FSType: "tmpfs", Target: "relative"}); err == nil {
+		t.Fatal("expected an error for a relative target")
+	}
+	for _, name := range []string{"cgroup2", "devpts"} {
+		m, err := MountByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.AddMount(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.AddMount(Mount{FSType: "tmpfs", Target: "/tmp/", Data: "size=10M"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var targets []string
+	for _, m := range b.mounts {
+		targets = append(targets, m.Target)
+	}
+	expected := []string{
+		"/dev", "/tmp", "/proc", "/sys", "/sys/kernel/security", "/sys/fs/bpf",
+		"/sys/fs/cgroup", "/dev/pts",
+	}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Fatalf("mount targets did not match. Got: %#v\nExpected: %#v", targets, expected)
+	}
+	if b.mounts[1].Data != "size=10M" {
+		t.Fatalf("mount at /tmp was not replaced: %#v", b.mounts[1])
+	}
+
+	if err := b.Generate(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMknod(t *testing.T) {
+	b := New()
+	if err := b.Mknod("dev/fuse", CharDevice, 10, 229, 0o666); err == nil {
+		t.Fatal("expected an error for a relative path")
+	}
+	if err := b.Mknod("/dev/net/tun", CharDevice, 10, 200, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Mknod("/dev/tty", CharDevice, 5, 0, 0o620); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Mknod("/dev/foo", CharDevice, 1<<12, 0, 0o600); err == nil {
+		t.Fatal("expected an error for a major number out of range")
+	}
+
+	expected := []nod{
+		{path: "/dev/tty", mode: 0o020620, dev: 0x0500},
+		{path: "/dev/urandom", mode: 0o020444, dev: 0x0109},
+		{path: "/dev/net/tun", mode: 0o020666, dev: 0x0ac8},
+	}
+	if !reflect.DeepEqual(b.nodes, expected) {
+		t.Fatalf("device nodes did not match. Got: %#v\nExpected: %#v", b.nodes, expected)
+	}
+	// Replacing a default device node must not change the defaults of other archives.
+	if nodes := New().nodes; !reflect.DeepEqual(nodes, defaultNodes) || nodes[0].mode != 0o020666 {
+		t.Fatalf("default device nodes were modified: %#v", nodes)
+	}
+	if dev := mkdev(0x1234, 0x12345); dev != 0x100012323445 {
+		t.Fatalf("unexpected device number 0x%x", dev)
+	}
+
+	if err := b.Generate(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmbedDevice(t *testing.T) {
+	b := New()
+	if err := b.EmbedDevice("dev/net/tun", CharDevice, 10, 200, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.EmbedDevice("/dev/loop0", BlockDevice, 7, 0, 0o660); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.EmbedDevice("dev/loop0", BlockDevice, 7, 1, 0o660); err == nil {
+		t.Fatal("expected an error for embedding the same path twice")
+	}
+	if err := b.EmbedDevice("bluebox/tun", CharDevice, 10, 200, 0o666); err == nil {
+		t.Fatal("expected an error for an invalid destination")
+	}
+	if err := b.EmbedDevice("dev/foo", CharDevice, 10, 1<<20, 0o666); err == nil {
+		t.Fatal("expected an error for a minor number out of range")
+	}
+
+	var archive bytes.Buffer
+	if err := b.Generate(&archive); err != nil {
+		t.Fatal(err)
+	}
+	raw := archive.Bytes()
+
+	c, err := ReadConfig(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"/dev/net/tun", "/dev/loop0"}; !reflect.DeepEqual(c.ArchiveNodes, expected) {
+		t.Fatalf("archive nodes did not match. Got: %#v\nExpected: %#v", c.ArchiveNodes, expected)
+	}
+
+	expected := []string{"init", "bluebox-init", "bluebox.json", "dev", "dev/net", "dev/net/tun", "dev/loop0"}
+	if names := archiveNames(t, &archive); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("archive entries did not match. Got: %#v\nExpected: %#v", names, expected)
+	}
+
+	// All entries need their own inode, as the kernel links regular files with the same inode.
+	inodes := make(map[string]string)
+	for i := 0; ; {
+		hdr := string(raw[i : i+110])
+		nameSize, _ := strconv.ParseInt(hdr[94:102], 16, 64)
+		size, _ := strconv.ParseInt(hdr[54:62], 16, 64)
+		name := string(raw[i+110 : i+110+int(nameSize)-1])
+		if name == "TRAILER!!!" {
+			break
+		}
+		if other, ok := inodes[hdr[6:14]]; ok {
+			t.Fatalf("%s uses the inode of %s", name, other)
+		}
+		inodes[hdr[6:14]] = name
+		i += 110 + int(nameSize)
+		i += (4 - i%4) % 4
+		i += int(size)
+		i += (4 - i%4) % 4
+	}
+	if len(inodes) != len(expected) {
+		t.Fatalf("expected %d inodes but got %d", len(expected), len(inodes))
+	}
+
+	for name, header := range map[string]string{
+		"dev/net/tun": "000021B6", // mode of the character device
+		"dev/loop0":   "000061B0", // mode of the block device
+	} {
+		idx := bytes.Index(raw, []byte(name+"\x00"))
+		if idx < 110 {
+			t.Fatalf("missing header of %s", name)
+		}
+		hdr := string(raw[idx-110 : idx])
+		if mode := hdr[14:22]; mode != header {
+			t.Fatalf("unexpected mode %s of %s", mode, name)
+		}
+		rdev := hdr[78:94]
+		switch {
+		case name == "dev/net/tun" && rdev != "0000000A000000C8",
+			name == "dev/loop0" && rdev != "0000000700000000":
+			t.Fatalf("unexpected device number %s of %s", rdev, name)
+		}
+	}
+}
+
+func TestLoadModule(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"foo.ko", "bar.ko.zst", "baz.o"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := New()
+	if err := b.LoadModule(filepath.Join(dir, "baz.o")); err == nil {
+		t.Fatal("expected an error for a file without the suffix of a kernel module")
+	}
+	if err := b.LoadModule(filepath.Join(dir, "foo.ko"), "debug=1", "bar=2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.LoadModule(filepath.Join(dir, "bar.ko.zst")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.LoadModule(filepath.Join(dir, "foo.ko")); err == nil {
+		t.Fatal("expected an error for loading the same module twice")
+	}
+
+	expected := []module{
+		{path: "lib/modules/foo.ko", params: "debug=1 bar=2"},
+		{path: "lib/modules/bar.ko.zst"},
+	}
+	if !reflect.DeepEqual(b.modules, expected) {
+		t.Fatalf("modules did not match. Got: %#v\nExpected: %#v", b.modules, expected)
+	}
+
+	b.SetModuleErrorsFatal(true)
+	var archive bytes.Buffer
+	if err := b.Generate(&archive); err != nil {
+		t.Fatal(err)
+	}
+	expectedNames := []string{
+		"init", "bluebox-init", "bluebox.json", "lib", "lib/modules", "lib/modules/foo.ko", "lib/modules/bar.ko.zst",
+	}
+	if names := archiveNames(t, &archive); !reflect.DeepEqual(names, expectedNames) {
+		t.Fatalf("archive entries did not match. Got: %#v\nExpected: %#v", names, expectedNames)
+	}
+
+	if err := b.Setarch("sparc64"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Generate(io.Discard); err == nil {
+		t.Fatal("expected an error for loading kernel modules on sparc64")
+	}
+}
+
+func TestLoadModulesFrom(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "6.12.0")
+	files := []string{
+		"kernel/net/foo.ko", "kernel/net/bar-core.ko.xz", "kernel/lib/baz.ko", "kernel/lib/unused.ko",
+	}
+	for _, file := range files {
+		name := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dep := "kernel/net/foo.ko: kernel/net/bar-core.ko.xz kernel/lib/baz.ko\n" +
+		"kernel/net/bar-core.ko.xz: kernel/lib/baz.ko\n" +
+		"kernel/lib/baz.ko:\n" +
+		"kernel/lib/unused.ko:\n"
+	if err := os.WriteFile(filepath.Join(dir, "modules.dep"), []byte(dep), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	builtin := []byte("kernel/fs/ext4/ext4.ko\n")
+	if err := os.WriteFile(filepath.Join(dir, "modules.builtin"), builtin, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := New()
+	if err := b.LoadModulesFrom(dir, "missing"); err == nil {
+		t.Fatal("expected an error for a missing module")
+	}
+	if err := b.LoadModulesFrom(dir, "foo", "ext4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.LoadModulesFrom(dir, "bar_core"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []module{
+		{path: "lib/modules/6.12.0/kernel/lib/baz.ko"},
+		{path: "lib/modules/6.12.0/kernel/net/bar-core.ko.xz"},
+		{path: "lib/modules/6.12.0/kernel/net/foo.ko"},
+	}
+	if !reflect.DeepEqual(b.modules, expected) {
+		t.Fatalf("modules did not match. Got: %#v\nExpected: %#v", b.modules, expected)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	b := New()
+	for _, l := range []Link{
+		{Name: "lo"},
+		{Name: "eth0", Addresses: []string{"10.0.2.15/24"}},
+		{Name: "veth0", Kind: "veth", Peer: "veth1", Addresses: []string{"fd00::1/64"}},
+	} {
+		if err := b.AddLink(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, l := range []Link{
+		{Name: "lo"},
+		{Name: "interface-name-too-long"},
+		{Name: "bond0", Kind: "bond"},
+		{Name: "veth2", Kind: "veth"},
+		{Name: "eth1", Addresses: []string{"10.0.3.15"}},
+	} {
+		if err := b.AddLink(l); err == nil {
+			t.Fatalf("expected an error for %#v", l)
+		}
+	}
+
+	for _, r := range []Route{
+		{Dst: "default", Gateway: "10.0.2.2"},
+		{Dst: "fd01::/64", Dev: "veth0"},
+	} {
+		if err := b.AddRoute(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range []Route{
+		{Dst: "default"},
+		{Dst: "10.1.0.0/16", Gateway: "fd00::2"},
+		{Dst: "10.1.0.0", Dev: "eth0"},
+	} {
+		if err := b.AddRoute(r); err == nil {
+			t.Fatalf("expected an error for %#v", r)
+		}
+	}
+
+	if err := b.Generate(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddShare(t *testing.T) {
+	b := New()
+	if err := b.AddShare(Share{Tag: "testdata", Target: "/testdata", ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddShare(Share{Tag: "results", Target: "/results", FSType: "virtiofs"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddShare(Share{Tag: "results", Target: "/nfs", FSType: "nfs"}); err == nil {
+		t.Fatal("expected an error for an unsupported file system type")
+	}
+	if err := b.AddShare(Share{Target: "/results"}); err == nil {
+		t.Fatal("expected an error for a missing tag")
+	}
+
+	expected := []Mount{
+		{
+			Source: "testdata", Target: "/testdata", FSType: "9p", Flags: MountReadOnly,
+			Data: "trans=virtio,version=9p2000.L,msize=524288", Perm: 0o755,
+		},
+		{Source: "results", Target: "/results", FSType: "virtiofs", Perm: 0o755},
+	}
+	if mounts := b.mounts[len(b.mounts)-2:]; !reflect.DeepEqual(mounts, expected) {
+		t.Fatalf("mounts did not match. Got: %#v\nExpected: %#v", mounts, expected)
+	}
+}
+
+func TestSetArtifacts(t *testing.T) {
+	b := New()
+	for _, dir := range []string{"artifacts", "/"} {
+		if err := b.SetArtifacts(dir, "/dev/vda"); err == nil {
+			t.Fatalf("expected an error for directory %s", dir)
+		}
+	}
+	if err := b.SetArtifacts("/artifacts", "vda"); err == nil {
+		t.Fatal("expected an error for a relative device")
+	}
+	if err := b.SetArtifacts("/artifacts/", "/dev/vdb"); err != nil {
+		t.Fatal(err)
+	}
+	if b.artifactsDir != "/artifacts" || b.artifactsDevice != "/dev/vdb" {
+		t.Fatalf("unexpected artifacts configuration %s %s", b.artifactsDir, b.artifactsDevice)
+	}
+	if err := b.Generate(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	tests := map[string]struct {
+		artifacts    bool
+		coverDir     string
+		sendCoverage bool
+	}{
+		"console": {
+			coverDir:     "/coverage",
+			sendCoverage: true,
+		},
+		"artifacts": {
+			artifacts: true,
+			coverDir:  "/artifacts/coverage",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			b := New()
+			b.SetPrebuilt(false)
+			b.SetCoverage(true)
+			if tc.artifacts {
+				if err := b.SetArtifacts("/artifacts", "/dev/vda"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var archive bytes.Buffer
+			if err := b.Generate(&archive); err != nil {
+				t.Fatal(err)
+			}
+			c, err := ReadConfig(&archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.CoverDir != tc.coverDir || c.SendCoverage != tc.sendCoverage {
+				t.Fatalf("unexpected coverage configuration %s %v", c.CoverDir, c.SendCoverage)
+			}
+
+			dir := t.TempDir()
+			if err := b.DumpInit(dir); err != nil {
+				t.Fatal(err)
+			}
+			src, err := os.ReadFile(filepath.Join(dir, "bluebox.go"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, expected := range []string{
+				fmt.Sprintf("coverDir = %q", tc.coverDir),
+				fmt.Sprintf("sendCoverage = %v", tc.sendCoverage),
+			} {
+				if !bytes.Contains(src, []byte(expected)) {
+					t.Fatalf("bluebox.go does not contain %s", expected)
+				}
+			}
+		})
+	}
+}
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	generate := func(b *Bluebox) []byte {
+		t.Helper()
+		// Only compiled init programs are cached.
+		b.SetPrebuilt(false)
+		b.SetCacheDir(dir)
+		b.SetReproducible(true)
+		var archive bytes.Buffer
+		if err := b.Generate(&archive); err != nil {
+			t.Fatal(err)
+		}
+		return archive.Bytes()
+	}
+	count := func(expected int) {
+		t.Helper()
+		entries, err := ListCache(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != expected {
+			t.Fatalf("expected %d cache entries but got %d", expected, len(entries))
+		}
+	}
+
+	first := generate(New())
+	count(2)
+	if second := generate(New()); !bytes.Equal(first, second) {
+		t.Fatal("archive from cached init programs differs")
+	}
+	count(2)
+
+	// Only bluebox-init changes with the environment.
+	b := New()
+	b.Setenv("FOO", "bar")
+	generate(b)
+	count(3)
+
+	if removed, err := PruneCache(dir, time.Hour); err != nil || len(removed) != 0 {
+		t.Fatalf("expected no removed entries but got %d: %v", len(removed), err)
+	}
+	// Files, that were not added by bluebox, are kept.
+	key := strings.Repeat("ab", sha256.Size)
+	foreign := []string{filepath.Join(dir, "ab", "notes.txt"), filepath.Join(dir, "cd", key), filepath.Join(dir, key)}
+	for _, name := range foreign {
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if removed, err := PruneCache(dir, 0); err != nil || len(removed) != 3 {
+		t.Fatalf("expected 3 removed entries but got %d: %v", len(removed), err)
+	}
+	count(0)
+	for _, name := range foreign {
+		if _, err := os.Stat(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Directories without the tag of the build cache are never pruned.
+	other := t.TempDir()
+	name := filepath.Join(other, "ab", key)
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PruneCache(other, 0); err == nil {
+		t.Fatal("expected an error for a directory without cache tag")
+	}
+	if _, err := os.Stat(name); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := ListCache(filepath.Join(other, "missing")); err != nil || len(entries) != 0 {
+		t.Fatalf("expected no entries for a missing directory but got %d: %v", len(entries), err)
+	}
+}
+
+// archiveFile returns the content of the entry name in the cpio archive.
+func archiveFile(t *testing.T, archive io.Reader, name string) []byte {
+	t.Helper()
+	r := cpio.NewReader(archive)
+	for {
+		hdr, err := r.Next()
+		if err != nil {
+			t.Fatalf("failed to find %s: %v", name, err)
+		}
+		if hdr.Name == name {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return data
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	exe := testExecutable(t)
+	b := New()
+	b.SetPrebuilt(false)
+	if err := b.AddStep(Step{Executable: exe, Args: []string{"-test.v"}, Timeout: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	b.Setenv("FOO", "bar=baz")
+	if err := b.EmbedAs(exe, ConfigFile); err == nil {
+		t.Fatalf("expected an error for embedding %s", ConfigFile)
+	}
+
+	var archive bytes.Buffer
+	if err := b.Generate(&archive); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ParseConfig(archiveFile(t, &archive, ConfigFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Prebuilt || c.Arch != runtime.GOARCH || len(c.Mounts) != len(defaultMounts) {
+		t.Fatalf("unexpected configuration %#v", c)
+	}
+	if !reflect.DeepEqual(c.Env, []string{"FOO=bar=baz"}) {
+		t.Fatalf("unexpected environment %q", c.Env)
+	}
+	expected := []ConfigStep{{Path: "pkg.test", Args: []string{"-test.v"}, Timeout: time.Minute}}
+	if !reflect.DeepEqual(c.Steps, expected) {
+		t.Fatalf("unexpected steps %#v", c.Steps)
+	}
+	if _, err := ParseConfig([]byte(`{"version": 0}`)); err == nil {
+		t.Fatal("expected an error for an unsupported version")
+	}
+}
+
+func TestPrebuilt(t *testing.T) {
+	for _, arch := range PrebuiltArchs {
+		for _, name := range []string{"init", "bluebox-init"} {
+			if _, err := fs.Stat(prebuilt, "prebuilt/"+name+"-"+arch); err != nil {
+				t.Fatalf("missing prebuilt %s for %s, run go generate ./initramfs: %v", name, arch, err)
+			}
+		}
+		sum, err := fs.ReadFile(prebuilt, "prebuilt/sources-"+arch+".sha256")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := prebuiltSources(arch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(sum)) != expected {
+			t.Fatalf("prebuilt init programs for %s are outdated, run go generate ./initramfs", arch)
+		}
+	}
+	if !slices.Contains(PrebuiltArchs, runtime.GOARCH) {
+		t.Skipf("no prebuilt init programs for %s", runtime.GOARCH)
+	}
+
+	b := New()
+	// Without a Go toolchain only the prebuilt init programs can be used.
+	t.Setenv("PATH", "")
+	var archive bytes.Buffer
+	if err := b.Generate(&archive); err != nil {
+		t.Fatal(err)
+	}
+	data := archive.Bytes()
+	c, err := ParseConfig(archiveFile(t, bytes.NewReader(data), ConfigFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Prebuilt {
+		t.Fatal("expected prebuilt init programs")
+	}
+	expected, err := fs.ReadFile(prebuilt, "prebuilt/init-"+runtime.GOARCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(archiveFile(t, bytes.NewReader(data), "init"), expected) {
+		t.Fatal("init is not the prebuilt one")
+	}
+
+	// A cached build would hide the missing Go toolchain.
+	b.SetCacheDir("")
+	b.SetPrebuilt(false)
+	if err := b.Generate(io.Discard); err == nil {
+		t.Fatal("expected an error for compiling without a Go toolchain")
+	}
+}
+
+func TestDumpInit(t *testing.T) {
+	exe := testExecutable(t)
+	b := New()
+	b.SetPrebuilt(false)
+	if err := b.AddStep(Step{Executable: exe}); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "dump")
+	if err := b.DumpInit(dir); err != nil {
+		t.Fatal(err)
+	}
+	src, err := os.ReadFile(filepath.Join(dir, "bluebox.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(src, []byte(`"pkg.test"`)) {
+		t.Fatal("bluebox.go does not contain the step")
+	}
+	if !bytes.Contains(src, []byte("\nfunc parseCmdline(")) || bytes.Contains(src, []byte("package cmdline")) {
+		t.Fatal("bluebox.go does not contain the parser of the kernel command line")
+	}
+	if _, err := os.Stat(filepath.Join(dir, ConfigFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skipf("no shell to run %s: %v", buildScript, err)
+	}
+	if out, err := exec.Command(sh, filepath.Join(dir, buildScript)).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	for _, name := range []string{"init", "bluebox-init"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCmdlineCode(t *testing.T) {
+	code, err := cmdlineCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(code, "// cmdline holds") {
+		t.Fatalf("unexpected start of the parser of the kernel command line:\n%s", code[:min(len(code), 200)])
+	}
+	if strings.Contains(code, "package cmdline") || strings.Contains(code, "import (") {
+		t.Fatal("package clause or imports were not removed")
+	}
+}
+
+func TestWalk(t *testing.T) {
+	exe := testExecutable(t)
+	b := New()
+	if err := b.AddStep(Step{Executable: exe}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.EmbedDevice("dev/net/tun", CharDevice, 10, 200, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := b.Generate(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	// Append a compressed segment after zero padding, as the Linux kernel accepts it.
+	generated := archive.Len()
+	archive.Write(make([]byte, 8))
+	zw := gzip.NewWriter(&archive)
+	w := cpio.NewWriter(zw)
+	if err := w.WriteHeader(&cpio.Header{Name: "extra/link", Mode: cpio.TypeSymlink | 0o777, Size: 6}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("../foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := archive.Bytes()
+
+	entries := make(map[string]Entry)
+	if err := Walk(bytes.NewReader(data), func(e Entry, r io.Reader) error {
+		entries[e.Name] = e
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if e := entries["dev/net/tun"]; e.Major != 10 || e.Minor != 200 || e.Mode != fs.ModeDevice|fs.ModeCharDevice|0o666 {
+		t.Fatalf("unexpected device %#v", e)
+	}
+	if e := entries["pkg.test"]; e.Size != 8 || e.Segment != 0 || e.Compression != "" {
+		t.Fatalf("unexpected file %#v", e)
+	}
+	if e := entries["extra/link"]; e.Linkname != "../foo" || e.Segment != 1 || e.Compression != "gzip" {
+		t.Fatalf("unexpected symbolic link %#v", e)
+	}
+
+	c, err := ReadConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Steps) != 1 || c.Steps[0].Path != "pkg.test" {
+		t.Fatalf("unexpected steps %#v", c.Steps)
+	}
+
+	// Extract only the generated segment, as symbolic links are not supported everywhere.
+	dir := t.TempDir()
+	skipped, err := Extract(bytes.NewReader(data[:generated]), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(skipped, []string{"dev/net/tun"}) {
+		t.Fatalf("unexpected skipped entries %q", skipped)
+	}
+	if content, err := os.ReadFile(filepath.Join(dir, "pkg.test")); err != nil || string(content) != "pkg.test" {
+		t.Fatalf("unexpected content %q: %v", content, err)
+	}
+
+	if err := Walk(bytes.NewReader([]byte("garbage")), func(Entry, io.Reader) error { return nil }); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	archive := func(files map[string]string, mode cpio.FileMode, args ...string) []byte {
+		b := New()
+		b.execs = append(b.execs, step{dst: "pkg.test", args: args})
+		config, err := json.Marshal(b.config(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[ConfigFile] = string(config)
+
+		var buf bytes.Buffer
+		w := cpio.NewWriter(&buf)
+		for _, name := range slices.Sorted(maps.Keys(files)) {
+			if err := w.WriteHeader(&cpio.Header{Name: name, Mode: cpio.TypeReg | mode, Size: int64(len(files[name]))}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write([]byte(files[name])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	a := archive(map[string]string{"pkg.test": "a", "removed": "x"}, 0o755, "-test.v")
+	d, err := Compare(bytes.NewReader(a), bytes.NewReader(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Empty() {
+		t.Fatalf("expected no differences, got %#v", d)
+	}
+
+	b := archive(map[string]string{"pkg.test": "b", "added": "x"}, 0o700)
+	d, err = Compare(bytes.NewReader(a), bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := make(map[string]Change)
+	for _, e := range d.Entries {
+		changes[e.Name] = e.Change
+		if e.Name == "pkg.test" && (len(e.Fields) != 2 || e.Fields[0].Field != "mode" || e.Fields[1].Field != "sha256") {
+			t.Fatalf("unexpected fields %#v", e.Fields)
+		}
+	}
+	expected := map[string]Change{"added": Added, "removed": Removed, "pkg.test": Modified, ConfigFile: Modified}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("unexpected changes %v", changes)
+	}
+	expectedConfig := []FieldDiff{{Field: "steps[0].args[0]", Old: `"-test.v"`}}
+	if !reflect.DeepEqual(d.Config, expectedConfig) {
+		t.Fatalf("unexpected configuration differences %#v", d.Config)
+	}
+}
@@ -0,0 +1,127 @@
+// Package cmdline holds the parser of the bluebox.* parameters of the kernel command line, that
+// is used by bluebox-init. As the init programs are built without dependencies, the source of
+// this package, except for the package clause and imports, is pasted into bluebox-init.
+package cmdline
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cmdline holds the configuration from bluebox.* parameters of the kernel command line.
+type cmdline struct {
+	// steps selects the steps to run by number or name of the executable.
+	steps []string
+	// args are appended to the arguments of all executables.
+	args []string
+	// exeArgs are appended to the arguments of the executable with the given name.
+	exeArgs map[string][]string
+	// env holds additional environment variables in the form key=value.
+	env []string
+	// verbose enables additional output.
+	verbose bool
+	// shutdown is the action that is taken once all executables finished.
+	shutdown string
+}
+
+// splitCmdline splits the kernel command line s into parameters. Like the kernel, spaces
+// inside double quotes do not split parameters and the quotes are removed.
+func splitCmdline(s string) []string {
+	var params []string
+	var param strings.Builder
+	quoted, started := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			started = true
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if started {
+				params = append(params, param.String())
+				param.Reset()
+				started = false
+			}
+		default:
+			param.WriteRune(r)
+			started = true
+		}
+	}
+	if started {
+		params = append(params, param.String())
+	}
+	return params
+}
+
+// parseCmdline returns the configuration from the bluebox.* parameters of the kernel command
+// line s.
+func parseCmdline(s string) cmdline {
+	c := cmdline{exeArgs: make(map[string][]string), shutdown: "poweroff"}
+	for _, param := range splitCmdline(s) {
+		key, value, _ := strings.Cut(param, "=")
+		name, ok := strings.CutPrefix(key, "bluebox.")
+		if !ok {
+			continue
+		}
+		switch name {
+		case "steps":
+			c.steps = append(c.steps, strings.Split(value, ",")...)
+		case "args":
+			c.args = append(c.args, strings.Fields(value)...)
+		case "env":
+			if !strings.Contains(value, "=") {
+				value += "=TRUE"
+			}
+			c.env = append(c.env, value)
+		case "verbose":
+			c.verbose = value == "" || value == "1" || value == "true"
+		case "shutdown":
+			switch value {
+			case "poweroff", "reboot", "halt", "wait":
+				c.shutdown = value
+			default:
+				fmt.Fprintf(os.Stderr, "[            ]\tIgnoring unknown shutdown action '%s'\n", value)
+			}
+		default:
+			if exe, ok := strings.CutPrefix(name, "args."); ok {
+				c.exeArgs[exe] = append(c.exeArgs[exe], strings.Fields(value)...)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "[            ]\tIgnoring unknown parameter '%s'\n", key)
+		}
+	}
+	return c
+}
+
+// selected returns the indices of execs, that are selected by c. Steps, that select none of execs,
+// are ignored.
+func (c cmdline) selected(execs []string) []int {
+	var indices []int
+	for i, exe := range execs {
+		if len(c.steps) == 0 {
+			indices = append(indices, i)
+			continue
+		}
+		for _, step := range c.steps {
+			if step == strconv.Itoa(i+1) || step == exe || step == filepath.Base(exe) {
+				indices = append(indices, i)
+				break
+			}
+		}
+	}
+	return indices
+}
+
+// arguments returns the arguments of the executable exe, that has the arguments exeArgs in the
+// archive.
+func (c cmdline) arguments(exe string, exeArgs []string) []string {
+	args := append([]string{}, exeArgs...)
+	args = append(args, c.args...)
+	args = append(args, c.exeArgs[exe]...)
+	if base := filepath.Base(exe); base != exe {
+		args = append(args, c.exeArgs[base]...)
+	}
+	return args
+}
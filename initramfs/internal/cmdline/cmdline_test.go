@@ -0,0 +1,212 @@
+package cmdline
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCmdline(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		params []string
+	}{
+		"empty": {
+			input: "",
+		},
+		"spaces only": {
+			input: " \t\n",
+		},
+		"plain": {
+			input:  "console=ttyS0  quiet\tbluebox.verbose\n",
+			params: []string{"console=ttyS0", "quiet", "bluebox.verbose"},
+		},
+		"quoted value": {
+			input:  `bluebox.args="-test.v -test.run=Foo" quiet`,
+			params: []string{"bluebox.args=-test.v -test.run=Foo", "quiet"},
+		},
+		"quoted parameter": {
+			input:  `"bluebox.env=A=b c"`,
+			params: []string{"bluebox.env=A=b c"},
+		},
+		"empty quotes": {
+			input:  `bluebox.args="" quiet`,
+			params: []string{"bluebox.args=", "quiet"},
+		},
+		"unterminated quote": {
+			input:  `bluebox.args="-test.v quiet`,
+			params: []string{"bluebox.args=-test.v quiet"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if params := splitCmdline(tc.input); !reflect.DeepEqual(params, tc.params) {
+				t.Fatalf("parameters did not match. Got: %#v\nExpected: %#v", params, tc.params)
+			}
+		})
+	}
+}
+
+func TestParseCmdline(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		expected cmdline
+	}{
+		"defaults": {
+			input:    "console=ttyS0 quiet",
+			expected: cmdline{exeArgs: map[string][]string{}, shutdown: "poweroff"},
+		},
+		"steps": {
+			input: "bluebox.steps=2,foo.test bluebox.steps=7",
+			expected: cmdline{
+				steps:    []string{"2", "foo.test", "7"},
+				exeArgs:  map[string][]string{},
+				shutdown: "poweroff",
+			},
+		},
+		"args": {
+			input: `bluebox.args="-test.v -test.count=1" bluebox.args=-test.short`,
+			expected: cmdline{
+				args:     []string{"-test.v", "-test.count=1", "-test.short"},
+				exeArgs:  map[string][]string{},
+				shutdown: "poweroff",
+			},
+		},
+		"executable args": {
+			input: `bluebox.args.foo.test="-test.run Foo" bluebox.args.bar/bar.test=-test.v`,
+			expected: cmdline{
+				exeArgs: map[string][]string{
+					"foo.test":     {"-test.run", "Foo"},
+					"bar/bar.test": {"-test.v"},
+				},
+				shutdown: "poweroff",
+			},
+		},
+		"env": {
+			input: `bluebox.env=DEBUG bluebox.env=LEVEL=3 "bluebox.env=NAME=a b"`,
+			expected: cmdline{
+				exeArgs:  map[string][]string{},
+				env:      []string{"DEBUG=TRUE", "LEVEL=3", "NAME=a b"},
+				shutdown: "poweroff",
+			},
+		},
+		"verbose without value": {
+			input:    "bluebox.verbose",
+			expected: cmdline{exeArgs: map[string][]string{}, verbose: true, shutdown: "poweroff"},
+		},
+		"verbose disabled": {
+			input:    "bluebox.verbose bluebox.verbose=0",
+			expected: cmdline{exeArgs: map[string][]string{}, shutdown: "poweroff"},
+		},
+		"shutdown": {
+			input:    "bluebox.shutdown=wait",
+			expected: cmdline{exeArgs: map[string][]string{}, shutdown: "wait"},
+		},
+		"unknown shutdown": {
+			input:    "bluebox.shutdown=reboot bluebox.shutdown=suspend",
+			expected: cmdline{exeArgs: map[string][]string{}, shutdown: "reboot"},
+		},
+		"unknown parameter": {
+			input:    "bluebox.foo=bar blueboxsteps=1",
+			expected: cmdline{exeArgs: map[string][]string{}, shutdown: "poweroff"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := parseCmdline(tc.input)
+			if !reflect.DeepEqual(c, tc.expected) {
+				t.Fatalf("configuration did not match. Got: %#v\nExpected: %#v", c, tc.expected)
+			}
+		})
+	}
+}
+
+func TestSelected(t *testing.T) {
+	execs := []string{"foo.test", "pkg/bar.test", "foo.test"}
+	tests := map[string]struct {
+		input   string
+		indices []int
+	}{
+		"all": {
+			input:   "",
+			indices: []int{0, 1, 2},
+		},
+		"by number": {
+			input:   "bluebox.steps=3,1",
+			indices: []int{0, 2},
+		},
+		"by name": {
+			input:   "bluebox.steps=foo.test",
+			indices: []int{0, 2},
+		},
+		"by base name": {
+			input:   "bluebox.steps=bar.test",
+			indices: []int{1},
+		},
+		"by path": {
+			input:   "bluebox.steps=pkg/bar.test",
+			indices: []int{1},
+		},
+		"out of range": {
+			input:   "bluebox.steps=0,4,-1",
+			indices: nil,
+		},
+		"partly out of range": {
+			input:   "bluebox.steps=2,42",
+			indices: []int{1},
+		},
+		"unknown name": {
+			input:   "bluebox.steps=baz.test",
+			indices: nil,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			indices := parseCmdline(tc.input).selected(execs)
+			if !reflect.DeepEqual(indices, tc.indices) {
+				t.Fatalf("selected steps did not match. Got: %#v\nExpected: %#v", indices, tc.indices)
+			}
+		})
+	}
+}
+
+func TestArguments(t *testing.T) {
+	c := parseCmdline(`bluebox.args=-test.v bluebox.args.bar.test="-test.run Bar" ` +
+		`bluebox.args.pkg/bar.test=-test.short bluebox.args.foo.test=-test.count=2`)
+
+	tests := map[string]struct {
+		exe      string
+		exeArgs  []string
+		expected []string
+	}{
+		"without executable args": {
+			exe:      "baz.test",
+			exeArgs:  []string{"-test.bench=."},
+			expected: []string{"-test.bench=.", "-test.v"},
+		},
+		"by name": {
+			exe:      "foo.test",
+			expected: []string{"-test.v", "-test.count=2"},
+		},
+		"by path and base name": {
+			exe:      "pkg/bar.test",
+			exeArgs:  []string{"-test.timeout=1m"},
+			expected: []string{"-test.timeout=1m", "-test.v", "-test.short", "-test.run", "Bar"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			args := c.arguments(tc.exe, tc.exeArgs)
+			if !reflect.DeepEqual(args, tc.expected) {
+				t.Fatalf("arguments did not match. Got: %#v\nExpected: %#v", args, tc.expected)
+			}
+		})
+	}
+
+	// The arguments of the archive must not be modified.
+	exeArgs := make([]string, 1, 4)
+	exeArgs[0] = "-test.v"
+	c.arguments("foo.test", exeArgs)
+	if exeArgs[:2][1] != "" {
+		t.Fatalf("arguments of the archive were modified: %#v", exeArgs[:2])
+	}
+}
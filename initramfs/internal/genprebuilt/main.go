@@ -0,0 +1,23 @@
+// Command genprebuilt compiles the generic init programs for all architectures in
+// initramfs.PrebuiltArchs into the directory given as argument.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/florianl/bluebox/initramfs"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s <dir>\n", os.Args[0])
+		os.Exit(2)
+	}
+	for _, arch := range initramfs.PrebuiltArchs {
+		if err := initramfs.WritePrebuilt(os.Args[1], arch); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", arch, err)
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package initramfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// finitModule maps GOARCH values to the number of the finit_module(2) syscall, as it is not
+// defined by package syscall for all architectures.
+var finitModule = map[string]int{
+	"386":      350,
+	"amd64":    313,
+	"arm":      379,
+	"arm64":    273,
+	"loong64":  273,
+	"mips":     4348,
+	"mipsle":   4348,
+	"mips64":   5307,
+	"mips64le": 5307,
+	"ppc64":    353,
+	"ppc64le":  353,
+	"riscv64":  273,
+	"s390x":    344,
+}
+
+// moduleSuffixes lists the accepted file name suffixes of kernel modules. Except for .ko, the
+// Linux kernel needs to be built with support to decompress the module.
+var moduleSuffixes = []string{".ko", ".ko.gz", ".ko.xz", ".ko.zst"}
+
+// module describes a kernel module, that is loaded by the generated init.
+type module struct {
+	// path of the module inside the archive.
+	path string
+	// params holds the module parameters separated by spaces.
+	params string
+}
+
+func (m module) String() string {
+	return fmt.Sprintf("\tif !loadModule(%q, %q) && moduleErrorsFatal {\n\t\treturn\n\t}\n",
+		"/"+m.path, m.params)
+}
+
+// isModule reports whether name has the suffix of a kernel module.
+func isModule(name string) bool {
+	for _, suffix := range moduleSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadModule embeds the kernel module file into the resulting archive and loads it with params
+// from the generated init, before the executables are run. Modules are loaded in the order they
+// were added. Besides .ko files, modules compressed with gzip, xz and zstd are accepted.
+func (b *Bluebox) LoadModule(file string, params ...string) error {
+	return b.loadModuleAs(file, path.Join("lib/modules", filepath.Base(file)), params...)
+}
+
+// loadModuleAs embeds the kernel module file at dst into the archive and loads it with params.
+func (b *Bluebox) loadModuleAs(file, dst string, params ...string) error {
+	if !isModule(file) {
+		return fmt.Errorf("%s is not a kernel module", file)
+	}
+	if err := b.EmbedAs(file, dst); err != nil {
+		return err
+	}
+	b.modules = append(b.modules, module{
+		path:   b.embeddings[len(b.embeddings)-1].dst,
+		params: strings.Join(params, " "),
+	})
+	return nil
+}
+
+// SetModuleErrorsFatal configures whether a kernel module, that can not be loaded, stops the
+// generated init. Then no executable is run and the VM is shut down. By default errors are
+// reported and the remaining modules and executables are still loaded and run.
+func (b *Bluebox) SetModuleErrorsFatal(fatal bool) {
+	b.moduleErrorsFatal = fatal
+}
+
+// moduleName returns the name of the kernel module file. Like modprobe, dashes and underscores
+// are not distinguished.
+func moduleName(file string) string {
+	name := path.Base(filepath.ToSlash(file))
+	for _, suffix := range moduleSuffixes {
+		if base, ok := strings.CutSuffix(name, suffix); ok {
+			name = base
+			break
+		}
+	}
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// moduleInfo describes a kernel module inside a modules tree.
+type moduleInfo struct {
+	// path of the module relative to the modules tree.
+	path string
+	// deps holds the names of the modules this module depends on.
+	deps []string
+}
+
+// LoadModulesFrom embeds the kernel modules names from the modules tree dir, e.g.
+// /lib/modules/6.12.0, together with all modules they depend on. The modules are placed at
+// lib/modules/<version>/ inside the archive and loaded in dependency order by the generated init,
+// like modprobe does. Dependencies are taken from modules.dep of dir. If it does not exist, the
+// .modinfo section of the modules is read instead. Modules that are built into the kernel
+// according to modules.builtin are skipped.
+func (b *Bluebox) LoadModulesFrom(dir string, names ...string) error {
+	tree, err := readModulesDep(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		tree, err = readModinfo(dir)
+	}
+	if err != nil {
+		return err
+	}
+	builtin, err := readModulesBuiltin(dir)
+	if err != nil {
+		return err
+	}
+
+	var order []string
+	state := make(map[string]int) // 1: visiting, 2: done
+	var visit func(name string, chain []string) error
+	visit = func(name string, chain []string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("circular dependency of kernel modules: %s",
+				strings.Join(append(chain, name), " -> "))
+		case 2:
+			return nil
+		}
+		info, ok := tree[name]
+		if !ok {
+			if builtin[name] {
+				state[name] = 2
+				return nil
+			}
+			return fmt.Errorf("kernel module %s not found in %s", name, dir)
+		}
+		state[name] = 1
+		for _, dep := range info.deps {
+			if err := visit(dep, append(chain, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(moduleName(name), nil); err != nil {
+			return err
+		}
+	}
+
+	version := filepath.Base(filepath.Clean(dir))
+	for _, name := range order {
+		rel := tree[name].path
+		dst := path.Join("lib/modules", version, rel)
+		if b.hasModule(dst) {
+			// Shared dependencies of multiple calls are loaded only once.
+			continue
+		}
+		if err := b.loadModuleAs(filepath.Join(dir, filepath.FromSlash(rel)), dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasModule reports whether the kernel module at dst inside the archive is already loaded.
+func (b *Bluebox) hasModule(dst string) bool {
+	for _, m := range b.modules {
+		if m.path == dst {
+			return true
+		}
+	}
+	return false
+}
+
+// readModulesDep reads the dependencies of all kernel modules from modules.dep of the modules
+// tree dir. Each line has the format "path: dependency...".
+func readModulesDep(dir string) (map[string]moduleInfo, error) {
+	f, err := os.Open(filepath.Join(dir, "modules.dep"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tree := make(map[string]moduleInfo)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		file, deps, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid line in modules.dep: %s", line)
+		}
+		info := moduleInfo{path: file}
+		for _, dep := range strings.Fields(deps) {
+			info.deps = append(info.deps, moduleName(dep))
+		}
+		tree[moduleName(file)] = info
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read modules.dep: %v", err)
+	}
+	return tree, nil
+}
+
+// readModulesBuiltin returns the names of the kernel modules, that are built into the kernel
+// according to modules.builtin of the modules tree dir.
+func readModulesBuiltin(dir string) (map[string]bool, error) {
+	builtin := make(map[string]bool)
+	data, err := os.ReadFile(filepath.Join(dir, "modules.builtin"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return builtin, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Fields(string(data)) {
+		builtin[moduleName(line)] = true
+	}
+	return builtin, nil
+}
+
+// readModinfo reads the dependencies of all kernel modules in the modules tree dir from their
+// .modinfo section. Only uncompressed and gzip compressed modules are supported.
+func readModinfo(dir string) (map[string]moduleInfo, error) {
+	tree := make(map[string]moduleInfo)
+	err := filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isModule(file) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+
+		deps, err := moduleDepends(file)
+		if err != nil {
+			return fmt.Errorf("failed to read dependencies of %s: %v", file, err)
+		}
+		info := moduleInfo{path: filepath.ToSlash(rel)}
+		for _, dep := range deps {
+			info.deps = append(info.deps, moduleName(dep))
+		}
+		tree[moduleName(file)] = info
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// moduleDepends returns the names of the kernel modules file depends on according to the depends
+// entry of its .modinfo section.
+func moduleDepends(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasSuffix(file, ".ko.gz"):
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(r); err != nil {
+			return nil, err
+		}
+	case !strings.HasSuffix(file, ".ko"):
+		return nil, fmt.Errorf("compressed module is not supported without modules.dep")
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	section := f.Section(".modinfo")
+	if section == nil {
+		return nil, fmt.Errorf("missing .modinfo section")
+	}
+	modinfo, err := section.Data()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range bytes.Split(modinfo, []byte{0}) {
+		if deps, ok := bytes.CutPrefix(entry, []byte("depends=")); ok {
+			if len(deps) == 0 {
+				return nil, nil
+			}
+			return strings.Split(string(deps), ","), nil
+		}
+	}
+	return nil, nil
+}
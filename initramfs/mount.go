@@ -0,0 +1,166 @@
+package initramfs
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"path"
+	"slices"
+)
+
+// Flags for Mount. They map to the MS_* flags of mount(2) and are defined here, so they are
+// also available when bluebox itself is not built for Linux.
+const (
+	MountReadOnly uintptr = 0x1      // MS_RDONLY
+	MountNoSuid   uintptr = 0x2      // MS_NOSUID
+	MountNoDev    uintptr = 0x4      // MS_NODEV
+	MountNoExec   uintptr = 0x8      // MS_NOEXEC
+	MountNoAtime  uintptr = 0x400    // MS_NOATIME
+	MountRelatime uintptr = 0x200000 // MS_RELATIME
+)
+
+// Mount describes a file system, that is mounted by the generated init before the executables
+// are run. It maps to https://pkg.go.dev/syscall#Mount.
+type Mount struct {
+	// Source is passed as source to mount(2). If empty, FSType is used.
+	Source string `json:"source,omitempty"`
+	// Target is the absolute path of the mount point in the guest.
+	Target string `json:"target"`
+	// FSType is the type of the file system, e.g. tmpfs.
+	FSType string `json:"fstype"`
+	// Flags is a combination of the Mount* flags.
+	Flags uintptr `json:"flags,omitempty"`
+	// Data holds file system specific options, e.g. size=10M for tmpfs.
+	Data string `json:"data,omitempty"`
+	// Perm holds the permission bits Target is created with, if it does not exist. If zero,
+	// Target is expected to exist.
+	Perm fs.FileMode `json:"perm,omitempty"`
+}
+
+func (m Mount) String() string {
+	return fmt.Sprintf("\tmountFS(%q, %q, %q, %d, %q, 0o%o)\n",
+		m.Source, m.Target, m.FSType, m.Flags, m.Data, uint32(m.Perm.Perm()))
+}
+
+// standardMounts maps names to commonly used file systems.
+var standardMounts = map[string]Mount{
+	"devtmpfs":   {Source: "devtmpfs", Target: "/dev", FSType: "devtmpfs", Perm: 0o755},
+	"tmpfs":      {Source: "tmpfs", Target: "/tmp", FSType: "tmpfs", Perm: 0o755},
+	"proc":       {Source: "proc", Target: "/proc", FSType: "proc", Perm: 0o555},
+	"sysfs":      {Source: "sysfs", Target: "/sys", FSType: "sysfs", Perm: 0o555},
+	"securityfs": {Source: "securityfs", Target: "/sys/kernel/security", FSType: "securityfs"},
+	"debugfs":    {Source: "debugfs", Target: "/sys/kernel/debug", FSType: "debugfs"},
+	"bpffs":      {Source: "bpffs", Target: "/sys/fs/bpf", FSType: "bpf"},
+	"cgroup2": {
+		Source: "cgroup2", Target: "/sys/fs/cgroup", FSType: "cgroup2",
+		Flags: MountNoSuid | MountNoDev | MountNoExec,
+	},
+	"tracefs":   {Source: "tracefs", Target: "/sys/kernel/tracing", FSType: "tracefs"},
+	"configfs":  {Source: "configfs", Target: "/sys/kernel/config", FSType: "configfs"},
+	"hugetlbfs": {Source: "hugetlbfs", Target: "/dev/hugepages", FSType: "hugetlbfs", Perm: 0o755},
+	"mqueue": {
+		Source: "mqueue", Target: "/dev/mqueue", FSType: "mqueue",
+		Flags: MountNoSuid | MountNoDev | MountNoExec, Perm: 0o755,
+	},
+	"devpts": {
+		Source: "devpts", Target: "/dev/pts", FSType: "devpts",
+		Flags: MountNoSuid | MountNoExec, Data: "ptmxmode=0666,mode=0620", Perm: 0o755,
+	},
+}
+
+// defaultMounts lists the names of the file systems, that are mounted by default in this order.
+var defaultMounts = []string{"devtmpfs", "tmpfs", "proc", "sysfs", "securityfs", "debugfs", "bpffs"}
+
+// MountByName returns the commonly used file system known by name, e.g. cgroup2 or devpts.
+func MountByName(name string) (Mount, error) {
+	m, ok := standardMounts[name]
+	if !ok {
+		return Mount{}, fmt.Errorf("unknown mount '%s'", name)
+	}
+	return m, nil
+}
+
+// StandardMounts returns the sorted names of all file systems known to MountByName.
+func StandardMounts() []string {
+	return slices.Sorted(maps.Keys(standardMounts))
+}
+
+// AddMount adds m to the file systems mounted by the generated init. Mounts are done in the
+// order they were added. If there is already a mount for the target of m, it is replaced in
+// place. By default devtmpfs, tmpfs, proc, sysfs, securityfs, debugfs and bpffs are mounted.
+func (b *Bluebox) AddMount(m Mount) error {
+	if m.FSType == "" {
+		return fmt.Errorf("missing file system type for mount at %s", m.Target)
+	}
+	if !path.IsAbs(m.Target) {
+		return fmt.Errorf("mount target %s is not an absolute path", m.Target)
+	}
+	m.Target = path.Clean(m.Target)
+	if m.Target == "/" {
+		return fmt.Errorf("can not mount %s on /", m.FSType)
+	}
+	if m.Source == "" {
+		m.Source = m.FSType
+	}
+
+	for i, existing := range b.mounts {
+		if existing.Target == m.Target {
+			b.mounts[i] = m
+			return nil
+		}
+	}
+	b.mounts = append(b.mounts, m)
+	return nil
+}
+
+// RemoveMount removes the mount at target, so it is not done by the generated init.
+func (b *Bluebox) RemoveMount(target string) error {
+	target = path.Clean(target)
+	for i, m := range b.mounts {
+		if m.Target == target {
+			b.mounts = slices.Delete(b.mounts, i, i+1)
+			return nil
+		}
+	}
+	return fmt.Errorf("no mount at %s", target)
+}
+
+// Share describes a directory of the host, that is mounted in the guest by the generated init. The
+// virtual machine needs a matching 9p or virtiofs device with Tag.
+type Share struct {
+	// Tag identifies the device of the share, e.g. the mount_tag of -virtfs in QEMU.
+	Tag string
+	// Target is the absolute path the share is mounted at in the guest. It is created, if it
+	// does not exist.
+	Target string
+	// FSType is either 9p, which uses the virtio transport, or virtiofs. By default 9p is used.
+	FSType string
+	// ReadOnly mounts the share read-only.
+	ReadOnly bool
+}
+
+// AddShare mounts the directory of the host shared with tag as s.Target in the guest. Like other
+// mounts, it replaces an existing mount with the same target.
+func (b *Bluebox) AddShare(s Share) error {
+	if s.Tag == "" {
+		return fmt.Errorf("missing tag for share at %s", s.Target)
+	}
+	m := Mount{
+		Source: s.Tag,
+		Target: s.Target,
+		FSType: s.FSType,
+		Perm:   0o755,
+	}
+	switch s.FSType {
+	case "", "9p":
+		m.FSType = "9p"
+		m.Data = "trans=virtio,version=9p2000.L,msize=524288"
+	case "virtiofs":
+	default:
+		return fmt.Errorf("unsupported file system type '%s' for share %s", s.FSType, s.Tag)
+	}
+	if s.ReadOnly {
+		m.Flags |= MountReadOnly
+	}
+	return b.AddMount(m)
+}
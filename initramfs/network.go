@@ -0,0 +1,109 @@
+package initramfs
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Link describes a network interface, that is configured by the generated init with netlink
+// before the executables are run.
+type Link struct {
+	// Name of the network interface, e.g. lo, eth0 or dummy0.
+	Name string `json:"name"`
+	// Kind of the network interface to create. It can be dummy or veth. If empty, the network
+	// interface is expected to exist, like lo or the interface of a virtio-net device.
+	Kind string `json:"kind,omitempty"`
+	// Peer is the name of the other end of a veth pair.
+	Peer string `json:"peer,omitempty"`
+	// Addresses holds the addresses with prefix length, e.g. 10.0.2.15/24, that are assigned
+	// to the network interface.
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+func (l Link) String() string {
+	return fmt.Sprintf("\tsetupLink(%q, %q, %q, %#v)\n", l.Name, l.Kind, l.Peer, l.Addresses)
+}
+
+// Route describes a route, that is added by the generated init once all links are configured.
+type Route struct {
+	// Dst is the destination with prefix length, e.g. 10.1.0.0/16, or default.
+	Dst string `json:"dst"`
+	// Gateway is the address of the next hop. It can be empty for routes via Dev.
+	Gateway string `json:"gateway,omitempty"`
+	// Dev is the name of the network interface to use for the route.
+	Dev string `json:"dev,omitempty"`
+}
+
+func (r Route) String() string {
+	return fmt.Sprintf("\taddRoute(%q, %q, %q)\n", r.Dst, r.Gateway, r.Dev)
+}
+
+// validLinkName reports whether name can be used as name of a network interface.
+func validLinkName(name string) bool {
+	// IFNAMSIZ includes the terminating NUL.
+	return name != "" && len(name) < 16 && !strings.ContainsAny(name, "/: \t\n")
+}
+
+// AddLink adds the network interface l, that is configured by the generated init. Network
+// interfaces are created, addressed and brought up in the order they were added. By default no
+// network interface is configured, not even lo.
+func (b *Bluebox) AddLink(l Link) error {
+	if !validLinkName(l.Name) {
+		return fmt.Errorf("invalid name '%s' of network interface", l.Name)
+	}
+	switch l.Kind {
+	case "", "dummy":
+		if l.Peer != "" {
+			return fmt.Errorf("network interface %s of kind '%s' can not have a peer", l.Name, l.Kind)
+		}
+	case "veth":
+		if !validLinkName(l.Peer) || l.Peer == l.Name {
+			return fmt.Errorf("invalid peer '%s' of network interface %s", l.Peer, l.Name)
+		}
+	default:
+		return fmt.Errorf("unsupported kind '%s' of network interface %s", l.Kind, l.Name)
+	}
+	for _, addr := range l.Addresses {
+		if _, err := netip.ParsePrefix(addr); err != nil {
+			return fmt.Errorf("invalid address of network interface %s: %v", l.Name, err)
+		}
+	}
+	for _, existing := range b.links {
+		if existing.Name == l.Name {
+			return fmt.Errorf("network interface %s is already configured", l.Name)
+		}
+	}
+	b.links = append(b.links, l)
+	return nil
+}
+
+// AddRoute adds the route r, that is added by the generated init once all network interfaces are
+// configured.
+func (b *Bluebox) AddRoute(r Route) error {
+	if r.Gateway == "" && r.Dev == "" {
+		return fmt.Errorf("route to %s requires a gateway or device", r.Dst)
+	}
+	if r.Dev != "" && !validLinkName(r.Dev) {
+		return fmt.Errorf("invalid device '%s' of route to %s", r.Dev, r.Dst)
+	}
+
+	var dst netip.Prefix
+	if r.Dst != "default" {
+		var err error
+		if dst, err = netip.ParsePrefix(r.Dst); err != nil {
+			return fmt.Errorf("invalid destination of route: %v", err)
+		}
+	}
+	if r.Gateway != "" {
+		gw, err := netip.ParseAddr(r.Gateway)
+		if err != nil {
+			return fmt.Errorf("invalid gateway of route to %s: %v", r.Dst, err)
+		}
+		if dst.IsValid() && dst.Addr().Is4() != gw.Is4() {
+			return fmt.Errorf("gateway %s does not match the address family of %s", r.Gateway, r.Dst)
+		}
+	}
+	b.routes = append(b.routes, r)
+	return nil
+}
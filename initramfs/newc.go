@@ -0,0 +1,84 @@
+package initramfs
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cavaliergopher/cpio"
+)
+
+// newcTrailer is the name of the entry, that marks the end of a cpio archive.
+const newcTrailer = "TRAILER!!!"
+
+// newcHeader holds the fields of an entry in a cpio archive, that are set by bluebox. Entries are
+// owned by root.
+type newcHeader struct {
+	name    string
+	mode    cpio.FileMode
+	modTime time.Time
+	size    int64
+	// rmajor and rminor are the device number of device nodes.
+	rmajor, rminor uint32
+}
+
+// newcWriter writes cpio archives in the newc format, that is unpacked by the Linux kernel.
+// Unlike cpio.Writer, it supports the device numbers of device nodes.
+type newcWriter struct {
+	w     io.Writer
+	inode uint32
+}
+
+// add writes the entry hdr to the archive. The content of regular files and the target of
+// symbolic links is read from r and needs to be hdr.size bytes long.
+func (w *newcWriter) add(hdr *newcHeader, r io.Reader) error {
+	if hdr.size > 1<<32-1 {
+		return fmt.Errorf("%s is too large for the cpio format", hdr.name)
+	}
+	// Each entry has its own inode, as the kernel would link regular files with the same
+	// inode and more than one link.
+	w.inode++
+	links := uint32(1)
+	if hdr.mode&cpio.ModeType == cpio.TypeDir {
+		links = 2
+	}
+	if err := w.writeHeader(w.inode, links, hdr); err != nil {
+		return err
+	}
+	if hdr.size == 0 {
+		return nil
+	}
+
+	n, err := io.Copy(w.w, io.LimitReader(r, hdr.size))
+	if err != nil {
+		return err
+	}
+	if n != hdr.size {
+		return fmt.Errorf("expected %d bytes of content but got %d", hdr.size, n)
+	}
+	_, err = io.WriteString(w.w, padding(int(n%4)))
+	return err
+}
+
+// close writes the trailer of the archive.
+func (w *newcWriter) close() error {
+	return w.writeHeader(0, 1, &newcHeader{name: newcTrailer})
+}
+
+// writeHeader writes hdr with inode and the number of links followed by the padded name.
+func (w *newcWriter) writeHeader(inode, links uint32, hdr *newcHeader) error {
+	var mtime int64
+	if !hdr.modTime.IsZero() {
+		mtime = hdr.modTime.Unix()
+	}
+	header := fmt.Sprintf("070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+		inode, uint32(hdr.mode), 0, 0, links, uint32(mtime), hdr.size, 0, 0,
+		hdr.rmajor, hdr.rminor, len(hdr.name)+1, 0)
+	_, err := io.WriteString(w.w, header+hdr.name+"\x00"+padding(len(header)+len(hdr.name)+1))
+	return err
+}
+
+// padding returns the zero bytes, that align an entry of size n to 4 bytes.
+func padding(n int) string {
+	return "\x00\x00\x00"[:(4-n%4)%4]
+}
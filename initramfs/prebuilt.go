@@ -0,0 +1,132 @@
+package initramfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+//go:generate go run ./internal/genprebuilt prebuilt
+
+// prebuilt holds the generic init programs, that read their configuration from ConfigFile.
+// They are named init-<GOARCH> and bluebox-init-<GOARCH>. Along with them, sources-<GOARCH>.sha256
+// holds the checksum of the Go sources, they were built from.
+//
+//go:embed prebuilt
+var prebuilt embed.FS
+
+// PrebuiltArchs lists the architectures, the generic init programs are generated for by
+// go generate.
+var PrebuiltArchs = []string{"386", "amd64", "arm", "arm64", "loong64", "ppc64le", "riscv64", "s390x"}
+
+// SetPrebuilt configures whether the generic, prebuilt init programs are placed into the archive,
+// if they are available for the architecture. They read their configuration from ConfigFile in
+// the archive, so no Go toolchain is needed to create the archive. Otherwise, or if there are no
+// prebuilt init programs for the architecture, the init programs are generated and compiled for
+// every archive. By default the prebuilt init programs are used.
+func (b *Bluebox) SetPrebuilt(enabled bool) {
+	b.noPrebuilt = !enabled
+}
+
+// copyPrebuilt writes the prebuilt init programs for the configured architecture to dir. It
+// returns false, if there are no prebuilt init programs for the architecture.
+func (b *Bluebox) copyPrebuilt(dir string) (bool, error) {
+	if !b.usePrebuilt() {
+		return false, nil
+	}
+	for _, name := range []string{"init", "bluebox-init"} {
+		data, err := fs.ReadFile(prebuilt, path.Join("prebuilt", name+"-"+b.arch))
+		if err != nil {
+			return false, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o755); err != nil {
+			return false, fmt.Errorf("failed to write prebuilt %s: %v", name, err)
+		}
+	}
+	return true, nil
+}
+
+// usePrebuilt reports whether the prebuilt init programs are placed into the archive.
+func (b *Bluebox) usePrebuilt() bool {
+	if b.noPrebuilt {
+		return false
+	}
+	for _, name := range []string{"init", "bluebox-init"} {
+		if _, err := fs.Stat(prebuilt, path.Join("prebuilt", name+"-"+b.arch)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// WritePrebuilt compiles the generic init programs, that read their configuration from
+// ConfigFile, for arch and writes them to dir as init-<arch> and bluebox-init-<arch>. The
+// checksum of their sources is written to sources-<arch>.sha256, so outdated programs can be
+// detected. The programs are built reproducibly. This is used by go generate to create the
+// prebuilt init programs, that are embedded into bluebox.
+func WritePrebuilt(dir, arch string) error {
+	b := New()
+	if err := b.Setarch(arch); err != nil {
+		return err
+	}
+	b.SetReproducible(true)
+	b.SetCacheDir("")
+
+	tmpDir, err := os.MkdirTemp("", "bluebox-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := b.createInit(tmpDir, true); err != nil {
+		return fmt.Errorf("failed to create the initial executable: %v", err)
+	}
+	if err := b.createBluebox(tmpDir, true); err != nil {
+		return fmt.Errorf("failed to generate bluebox-init: %v", err)
+	}
+	for _, name := range []string{"init", "bluebox-init"} {
+		if err := copyExecutable(filepath.Join(tmpDir, name), filepath.Join(dir, name+"-"+arch)); err != nil {
+			return err
+		}
+	}
+	sum, err := prebuiltSources(arch)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "sources-"+arch+".sha256"), []byte(sum+"\n"), 0o644)
+}
+
+// prebuiltSources returns the SHA-256 of the Go sources of the generic init programs for arch.
+func prebuiltSources(arch string) (string, error) {
+	b := New()
+	if err := b.Setarch(arch); err != nil {
+		return "", err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "bluebox-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	h := sha256.New()
+	for _, write := range []func(string, bool) (string, error){b.writeInit, b.writeBluebox} {
+		src, err := write(tmpDir, true)
+		if err != nil {
+			return "", err
+		}
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return "", err
+		}
+		// The embedded parser of the kernel command line might be checked out with CRLF.
+		h.Write(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,337 @@
+package initramfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cavaliergopher/cpio"
+	exec "golang.org/x/sys/execabs"
+)
+
+// Entry describes a file in an initramfs archive.
+type Entry struct {
+	// Name is the path of the file in the archive without a leading slash.
+	Name    string
+	Mode    fs.FileMode
+	Size    int64
+	Uid     int
+	Gid     int
+	ModTime time.Time
+	// Linkname is the target of a symbolic link.
+	Linkname string
+	// Major and Minor are the device number of a device node.
+	Major uint32
+	Minor uint32
+	// Segment is the index of the cpio archive, the entry belongs to, within the initramfs
+	// archive. The Linux kernel accepts several concatenated cpio archives.
+	Segment int
+	// Compression is the name of the compression of the segment or empty, if it is not
+	// compressed.
+	Compression string
+}
+
+// WalkFunc is called by Walk for each entry of an archive. For regular files the content can be
+// read from r until fn returns.
+type WalkFunc func(e Entry, r io.Reader) error
+
+// decompressor detects a compressed segment by its magic bytes and decompresses it.
+type decompressor struct {
+	name  string
+	magic []byte
+	open  func(r io.Reader) (io.ReadCloser, error)
+}
+
+// decompressors lists the compressions the Linux kernel supports for initramfs archives. Besides
+// gzip, they depend on external programs, which read the archive up to its end.
+var decompressors = []decompressor{
+	{name: "gzip", magic: []byte{0x1f, 0x8b}, open: func(r io.Reader) (io.ReadCloser, error) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		// Stop at the end of the compressed segment, so the following segments are read.
+		zr.Multistream(false)
+		return zr, nil
+	}},
+	{name: "zstd", magic: []byte{0x28, 0xb5, 0x2f, 0xfd}, open: decompressCommand("zstd", "-q", "-d", "-c")},
+	{name: "xz", magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, open: decompressCommand("xz", "-q", "-d", "-c")},
+	{name: "lz4", magic: []byte{0x02, 0x21, 0x4c, 0x18}, open: decompressCommand("lz4", "-q", "-d", "-c")},
+	{name: "bzip2", magic: []byte("BZh"), open: decompressCommand("bzip2", "-q", "-d", "-c")},
+	{name: "lzma", magic: []byte{0x5d, 0x00, 0x00}, open: decompressCommand("xz", "-q", "-d", "-c", "--format=lzma")},
+	{name: "lzo", magic: []byte{0x89, 'L', 'Z', 'O'}, open: decompressCommand("lzop", "-q", "-d", "-c")},
+}
+
+// decompressCommand returns a function, that pipes its input through the external program name
+// with the given args and returns the output.
+func decompressCommand(name string, args ...string) func(r io.Reader) (io.ReadCloser, error) {
+	return func(r io.Reader) (io.ReadCloser, error) {
+		cmd := exec.Command(name, args...)
+		cmd.Stdin = r
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("failed to start %s: %v", name, err)
+		}
+		return &commandReader{ReadCloser: stdout, cmd: cmd}, nil
+	}
+}
+
+// commandReader reads from the stdout of an external program.
+type commandReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+// Close discards the remaining output and waits for the external program to finish.
+func (c *commandReader) Close() error {
+	io.Copy(io.Discard, c.ReadCloser)
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %v", c.cmd.Path, err)
+	}
+	return nil
+}
+
+// Walk reads the initramfs archive r and calls fn for each entry in the order of the archive. The
+// archive can consist of several concatenated cpio archives in the newc format, that are
+// optionally compressed. The content of a compressed segment can again consist of several
+// segments. If fn returns an error, Walk stops and returns it.
+func Walk(r io.Reader, fn WalkFunc) error {
+	var segment int
+	return walkArchive(bufio.NewReader(r), &segment, "", fn)
+}
+
+// walkArchive calls fn for the entries of all segments in r. segment is the index of the next
+// segment.
+func walkArchive(r *bufio.Reader, segment *int, compression string, fn WalkFunc) error {
+	for {
+		// Segments are padded with zeros.
+		magic, err := skipZeros(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if bytes.HasPrefix(magic, []byte("07070")) {
+			if err := walkSegment(r, *segment, compression, fn); err != nil {
+				return fmt.Errorf("segment %d: %v", *segment, err)
+			}
+			*segment++
+			continue
+		}
+
+		d, ok := findDecompressor(magic)
+		if !ok {
+			return fmt.Errorf("segment %d: unknown format", *segment)
+		}
+		rc, err := d.open(r)
+		if err != nil {
+			return fmt.Errorf("segment %d: %v", *segment, err)
+		}
+		err = walkArchive(bufio.NewReader(rc), segment, d.name, fn)
+		if cerr := rc.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// skipZeros discards zero bytes from r and returns the following bytes without consuming them.
+func skipZeros(r *bufio.Reader) ([]byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != 0 {
+			if err := r.UnreadByte(); err != nil {
+				return nil, err
+			}
+			magic, err := r.Peek(6)
+			if errors.Is(err, io.EOF) {
+				// Short inputs are reported as unknown format.
+				err = nil
+			}
+			return magic, err
+		}
+	}
+}
+
+// findDecompressor returns the decompressor for the magic bytes.
+func findDecompressor(magic []byte) (decompressor, bool) {
+	for _, d := range decompressors {
+		if bytes.HasPrefix(magic, d.magic) {
+			return d, true
+		}
+	}
+	return decompressor{}, false
+}
+
+// headerRecorder keeps the bytes read from r while recording is enabled, so that fields of the
+// cpio header, that cpio.Header does not provide, can be read.
+type headerRecorder struct {
+	r         io.Reader
+	buf       []byte
+	recording bool
+}
+
+// Read reads from r and records the data.
+func (h *headerRecorder) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	if h.recording {
+		h.buf = append(h.buf, p[:n]...)
+	}
+	return n, err
+}
+
+// record starts recording from scratch.
+func (h *headerRecorder) record() {
+	h.buf = h.buf[:0]
+	h.recording = true
+}
+
+// device returns the device number of the recorded header.
+func (h *headerRecorder) device() (uint32, uint32) {
+	h.recording = false
+	// The recording can start with the padding of the previous entry.
+	i := bytes.Index(h.buf, []byte("07070"))
+	if i < 0 || len(h.buf) < i+94 {
+		return 0, 0
+	}
+	major, _ := strconv.ParseUint(string(h.buf[i+78:i+86]), 16, 32)
+	minor, _ := strconv.ParseUint(string(h.buf[i+86:i+94]), 16, 32)
+	return uint32(major), uint32(minor)
+}
+
+// walkSegment calls fn for each entry of the cpio archive r up to its trailer.
+func walkSegment(r io.Reader, segment int, compression string, fn WalkFunc) error {
+	rec := &headerRecorder{r: r}
+	cr := cpio.NewReader(rec)
+	for {
+		rec.record()
+		hdr, err := cr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e := Entry{
+			Name:        strings.TrimLeft(path.Clean("/"+hdr.Name), "/"),
+			Mode:        hdr.FileInfo().Mode(),
+			Size:        hdr.Size,
+			Uid:         hdr.Uid,
+			Gid:         hdr.Guid,
+			ModTime:     hdr.ModTime,
+			Linkname:    hdr.Linkname,
+			Segment:     segment,
+			Compression: compression,
+		}
+		major, minor := rec.device()
+		if e.Mode&fs.ModeDevice != 0 {
+			e.Major, e.Minor = major, minor
+		}
+		if err := fn(e, cr); err != nil {
+			return err
+		}
+		// Skip the content, fn did not read, so only the padding is left for the header.
+		if _, err := io.Copy(io.Discard, cr); err != nil {
+			return err
+		}
+	}
+}
+
+// ReadConfig returns the configuration of the init programs from ConfigFile in the initramfs
+// archive r.
+func ReadConfig(r io.Reader) (Config, error) {
+	var data []byte
+	err := Walk(r, func(e Entry, r io.Reader) error {
+		if e.Name != ConfigFile || !e.Mode.IsRegular() {
+			return nil
+		}
+		var err error
+		data, err = io.ReadAll(r)
+		return err
+	})
+	if err != nil {
+		return Config{}, err
+	}
+	if data == nil {
+		return Config{}, fmt.Errorf("archive has no %s", ConfigFile)
+	}
+	return ParseConfig(data)
+}
+
+// Extract unpacks the initramfs archive r into dir, that is created if needed. Directories,
+// regular files and symbolic links are extracted and entries can not end up outside of dir. The
+// names of the skipped entries, like device nodes, are returned.
+func Extract(r io.Reader, dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+
+	var skipped []string
+	err = Walk(r, func(e Entry, r io.Reader) error {
+		if e.Name == "" {
+			return nil
+		}
+		name := filepath.FromSlash(e.Name)
+		if parent := filepath.Dir(name); parent != "." {
+			if err := root.MkdirAll(parent, 0o755); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case e.Mode.IsDir():
+			if err := root.MkdirAll(name, e.Mode.Perm()|0o700); err != nil {
+				return err
+			}
+		case e.Mode.IsRegular():
+			f, err := root.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, e.Mode.Perm()|0o600)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, r); err != nil {
+				f.Close()
+				return fmt.Errorf("failed to extract %s: %v", e.Name, err)
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case e.Mode&fs.ModeSymlink != 0:
+			// Later segments replace the entries of earlier ones.
+			if err := root.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			if err := root.Symlink(e.Linkname, name); err != nil {
+				return err
+			}
+		default:
+			skipped = append(skipped, e.Name)
+		}
+		return nil
+	})
+	return skipped, err
+}
@@ -0,0 +1,39 @@
+package initramfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// resultMarker starts the line bluebox-init prints with the aggregated result of all executables.
+const resultMarker = "[            ] bluebox-result: "
+
+// Result holds the aggregated result of all executables that were run by bluebox-init.
+type Result struct {
+	// Steps is the number of executables that were run.
+	Steps int
+	// Passed is the number of executables that exited with status 0.
+	Passed int
+	// Failed is the number of executables that could not be started, were terminated by a
+	// signal or exited with a status other than 0.
+	Failed int
+	// Exit is 0 if all executables passed and 1 otherwise.
+	Exit int
+}
+
+// ParseResult parses the result from a line of the console output of bluebox-init. It returns
+// false, if line does not start with the result. Executables can print the marker as well, so
+// the result is only accepted at the start of a line and the last one found counts.
+func ParseResult(line string) (Result, bool) {
+	fields, ok := strings.CutPrefix(line, resultMarker)
+	if !ok {
+		return Result{}, false
+	}
+
+	var r Result
+	if _, err := fmt.Sscanf(strings.TrimSpace(fields), "steps=%d passed=%d failed=%d exit=%d",
+		&r.Steps, &r.Passed, &r.Failed, &r.Exit); err != nil {
+		return Result{}, false
+	}
+	return r, true
+}
@@ -1,20 +1,58 @@
 package initramfs
 
+import "time"
+
 type initTemplateConfig struct {
-	Environment []environment
+	Environment       []environment
+	FinitModule       int
+	ModuleErrorsFatal bool
+	ConfigFile        string
+	ConfigVersion     int
+	// ArchiveNodes holds the device nodes below /dev, that are part of the archive.
+	ArchiveNodes []string
+	// Generic reads the environment from the configuration file in the archive instead.
+	Generic bool
 }
 
 var initTemplate string = `package main
 
 import (
+	"encoding/binary"
+{{- if .Generic}}
+	"encoding/json"
+{{- end}}
 	"fmt"
 	"io"
 	"io/fs"
+	"net"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"unsafe"
+)
+
+const (
+	// sysFinitModule is the number of the finit_module(2) syscall.
+	sysFinitModule = {{.FinitModule}}
+
+	// moduleInitCompressedFile lets the kernel decompress the module.
+	moduleInitCompressedFile = 4
+
+	// Netlink attributes, that are not defined by package syscall.
+	iflaInfoKind = 1
+	iflaInfoData = 2
+	vethInfoPeer = 1
 )
 
+// moduleErrorsFatal stops init, if a kernel module can not be loaded.
+var moduleErrorsFatal = {{.ModuleErrorsFatal}}
+
+// archiveNodes holds the device nodes below /dev, that are part of the archive. Unlike the rest of
+// /dev, they are moved to the new root file system.
+var archiveNodes = []string{ {{- range $i, $n := .ArchiveNodes}}{{if $i}}, {{end}}{{printf "%q" $n}}{{end -}} }
+
 func copyFile(src, dst string) error {
 	sourceFileStat, err := os.Stat(src)
 	if err != nil {
@@ -51,7 +89,7 @@ func copyFile(src, dst string) error {
 }
 
 func moveElements() error {
-	return filepath.WalkDir("/", func(path string, d fs.DirEntry, err error) error {
+	err := filepath.WalkDir("/", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -65,7 +103,32 @@ func moveElements() error {
 				// root fs and destination of moving all elements.
 				return fs.SkipDir
 			}
-			return os.MkdirAll(filepath.Join("/bluebox", path), 0o755)
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Join("/bluebox", path), 0o755); err != nil {
+				return err
+			}
+			// Preserve directory permissions.
+			return os.Chmod(filepath.Join("/bluebox", path),
+				info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky))
+		}
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			// Recreate the symbolic link in the new FS.
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(target, filepath.Join("/bluebox", path)); err != nil {
+				return err
+			}
+			return os.Remove(path)
+		}
+
+		if d.Type()&fs.ModeDevice != 0 {
+			return moveDevice(path)
 		}
 
 		// Move the file into the new FS.
@@ -76,6 +139,35 @@ func moveElements() error {
 		// With the file in the new FS remove it from the old one.
 		return os.Remove(path)
 	})
+	if err != nil {
+		return err
+	}
+
+	for _, path := range archiveNodes {
+		if err := os.MkdirAll(filepath.Join("/bluebox", filepath.Dir(path)), 0o755); err != nil {
+			return err
+		}
+		if err := moveDevice(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveDevice recreates the device node path in the new FS and removes it from the old one.
+func moveDevice(path string) error {
+	var stat syscall.Stat_t
+	if err := syscall.Lstat(path, &stat); err != nil {
+		return err
+	}
+	// The kernel only supports device numbers, that fit into 32 bits.
+	if err := syscall.Mknod(filepath.Join("/bluebox", path), stat.Mode, int(uint32(stat.Rdev))); err != nil {
+		return err
+	}
+	if err := syscall.Chmod(filepath.Join("/bluebox", path), stat.Mode&0o7777); err != nil {
+		return err
+	}
+	return os.Remove(path)
 }
 
 func prepareNewRoot() error {
@@ -94,6 +186,291 @@ func prepareNewRoot() error {
 	return nil
 }
 
+// mountFS mounts the file system fstype at target. If perm is not zero, target is created first.
+func mountFS(source, target, fstype string, flags uintptr, data string, perm os.FileMode) {
+	if perm != 0 {
+		fmt.Printf("[            ]\tos.MkdirAll(%q, 0o%o)\n", target, perm)
+		if err := os.MkdirAll(target, perm); err != nil {
+			fmt.Println("[            ]\tERROR:", err)
+		}
+	}
+	fmt.Printf("[            ]\tsyscall.Mount(%q, %q, %q, uintptr(%d), %q)\n", source, target, fstype, flags, data)
+	if err := syscall.Mount(source, target, fstype, flags, data); err != nil {
+		fmt.Println("[            ]\tERROR:", err)
+	}
+}
+
+// mknod creates the device node path with mode and dev. Missing parent directories are created.
+func mknod(path string, mode uint32, dev uint64) {
+	// The kernel only supports device numbers, that fit into 32 bits.
+	if dev>>32 != 0 {
+		fmt.Printf("[            ]\tERROR: device number 0x%x of %s is out of range\n", dev, path)
+		return
+	}
+	fmt.Printf("[            ]\tos.Remove(%q)\n", path)
+	os.Remove(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		fmt.Println("[            ]\tERROR:", err)
+	}
+	fmt.Printf("[            ]\tsyscall.Mknod(%q, 0x%x, 0x%x)\n", path, mode, dev)
+	if err := syscall.Mknod(path, mode, int(dev)); err != nil {
+		fmt.Println("[            ]\tERROR:", err)
+		return
+	}
+	// The permissions of mknod are subject to the umask.
+	if err := syscall.Chmod(path, mode&0o7777); err != nil {
+		fmt.Println("[            ]\tERROR:", err)
+	}
+}
+
+// loadModule loads the kernel module path with params and reports whether it succeeded. A module
+// that is already loaded is not considered an error.
+func loadModule(path, params string) bool {
+	fmt.Printf("[            ]\tinsmod %s %s\n", path, params)
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Println("[            ]\tERROR:", err)
+		return false
+	}
+	defer f.Close()
+
+	p, err := syscall.BytePtrFromString(params)
+	if err != nil {
+		fmt.Println("[            ]\tERROR:", err)
+		return false
+	}
+	flags := 0
+	if !strings.HasSuffix(path, ".ko") {
+		flags |= moduleInitCompressedFile
+	}
+	_, _, errno := syscall.Syscall(sysFinitModule, f.Fd(), uintptr(unsafe.Pointer(p)), uintptr(flags))
+	if errno != 0 && errno != syscall.EEXIST {
+		fmt.Printf("[            ]\tERROR: loading %s: %v\n", path, errno)
+		return false
+	}
+	return true
+}
+
+// nlAttr returns the netlink attribute typ with the payload data.
+func nlAttr(typ uint16, data []byte) []byte {
+	length := syscall.SizeofRtAttr + len(data)
+	attr := make([]byte, (length+syscall.RTA_ALIGNTO-1)&^(syscall.RTA_ALIGNTO-1))
+	binary.NativeEndian.PutUint16(attr[0:2], uint16(length))
+	binary.NativeEndian.PutUint16(attr[2:4], typ)
+	copy(attr[syscall.SizeofRtAttr:], data)
+	return attr
+}
+
+// nlString returns s as payload of a netlink attribute.
+func nlString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// netlinkRequest sends the rtnetlink request typ with data to the kernel and waits for its
+// acknowledgement.
+func netlinkRequest(typ, flags uint16, data []byte) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	msg := make([]byte, syscall.NLMSG_HDRLEN+len(data))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:6], typ)
+	binary.NativeEndian.PutUint16(msg[6:8], flags|syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(msg[8:12], 1)
+	copy(msg[syscall.NLMSG_HDRLEN:], data)
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, os.Getpagesize())
+	n, _, err := syscall.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if m.Header.Type != syscall.NLMSG_ERROR || len(m.Data) < 4 {
+			continue
+		}
+		if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+			return syscall.Errno(-errno)
+		}
+		return nil
+	}
+	return fmt.Errorf("missing acknowledgement")
+}
+
+// ifInfomsg returns the header of a RTM_NEWLINK request.
+func ifInfomsg(index int, flags, change uint32) []byte {
+	msg := make([]byte, syscall.SizeofIfInfomsg)
+	msg[0] = syscall.AF_UNSPEC
+	binary.NativeEndian.PutUint32(msg[4:8], uint32(index))
+	binary.NativeEndian.PutUint32(msg[8:12], flags)
+	binary.NativeEndian.PutUint32(msg[12:16], change)
+	return msg
+}
+
+// createLink creates the network interface name of kind. For veth, peer names the other end.
+func createLink(name, kind, peer string) error {
+	info := nlAttr(iflaInfoKind, nlString(kind))
+	if kind == "veth" {
+		peerInfo := append(ifInfomsg(0, 0, 0), nlAttr(syscall.IFLA_IFNAME, nlString(peer))...)
+		info = append(info, nlAttr(iflaInfoData, nlAttr(vethInfoPeer, peerInfo))...)
+	}
+	data := ifInfomsg(0, 0, 0)
+	data = append(data, nlAttr(syscall.IFLA_IFNAME, nlString(name))...)
+	data = append(data, nlAttr(syscall.IFLA_LINKINFO, info)...)
+	return netlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, data)
+}
+
+// linkIndex returns the index of the network interface name.
+func linkIndex(name string) (int, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return iface.Index, nil
+}
+
+// linkUp brings the network interface name up.
+func linkUp(name string) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	return netlinkRequest(syscall.RTM_NEWLINK, 0, ifInfomsg(index, syscall.IFF_UP, syscall.IFF_UP))
+}
+
+// addAddress assigns addr to the network interface name.
+func addAddress(name, addr string) error {
+	prefix, err := netip.ParsePrefix(addr)
+	if err != nil {
+		return err
+	}
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, syscall.SizeofIfAddrmsg)
+	data[0] = syscall.AF_INET6
+	if prefix.Addr().Is4() {
+		data[0] = syscall.AF_INET
+	}
+	data[1] = byte(prefix.Bits())
+	binary.NativeEndian.PutUint32(data[4:8], uint32(index))
+	ip := prefix.Addr().AsSlice()
+	data = append(data, nlAttr(syscall.IFA_LOCAL, ip)...)
+	data = append(data, nlAttr(syscall.IFA_ADDRESS, ip)...)
+	return netlinkRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, data)
+}
+
+// setupLink creates the network interface name, if kind is not empty, assigns addrs to it and
+// brings it up.
+func setupLink(name, kind, peer string, addrs []string) {
+	if kind != "" {
+		cmd := fmt.Sprintf("ip link add %s type %s", name, kind)
+		if peer != "" {
+			cmd += " peer name " + peer
+		}
+		fmt.Printf("[            ]\t%s\n", cmd)
+		if err := createLink(name, kind, peer); err != nil {
+			fmt.Println("[            ]\tERROR:", err)
+			return
+		}
+	}
+	for _, addr := range addrs {
+		fmt.Printf("[            ]\tip address add %s dev %s\n", addr, name)
+		if err := addAddress(name, addr); err != nil {
+			fmt.Println("[            ]\tERROR:", err)
+		}
+	}
+	links := []string{name}
+	if peer != "" {
+		links = append(links, peer)
+	}
+	for _, link := range links {
+		fmt.Printf("[            ]\tip link set %s up\n", link)
+		if err := linkUp(link); err != nil {
+			fmt.Println("[            ]\tERROR:", err)
+		}
+	}
+}
+
+// addRoute adds the route to dst via gateway or dev.
+func addRoute(dst, gateway, dev string) {
+	cmd := "ip route add " + dst
+	if gateway != "" {
+		cmd += " via " + gateway
+	}
+	if dev != "" {
+		cmd += " dev " + dev
+	}
+	fmt.Printf("[            ]\t%s\n", cmd)
+	if err := route(dst, gateway, dev); err != nil {
+		fmt.Println("[            ]\tERROR:", err)
+	}
+}
+
+// route adds the route to dst via gateway or dev with netlink.
+func route(dst, gateway, dev string) error {
+	var gw netip.Addr
+	if gateway != "" {
+		var err error
+		if gw, err = netip.ParseAddr(gateway); err != nil {
+			return err
+		}
+	}
+	var prefix netip.Prefix
+	switch {
+	case dst != "default":
+		var err error
+		if prefix, err = netip.ParsePrefix(dst); err != nil {
+			return err
+		}
+	case gw.Is6():
+		prefix = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+	default:
+		prefix = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+	}
+
+	data := make([]byte, syscall.SizeofRtMsg)
+	data[0] = syscall.AF_INET6
+	if prefix.Addr().Is4() {
+		data[0] = syscall.AF_INET
+	}
+	data[1] = byte(prefix.Bits())
+	data[4] = syscall.RT_TABLE_MAIN
+	data[5] = syscall.RTPROT_BOOT
+	data[6] = syscall.RT_SCOPE_UNIVERSE
+	if !gw.IsValid() {
+		data[6] = syscall.RT_SCOPE_LINK
+	}
+	data[7] = syscall.RTN_UNICAST
+	if prefix.Bits() > 0 {
+		data = append(data, nlAttr(syscall.RTA_DST, prefix.Masked().Addr().AsSlice())...)
+	}
+	if gw.IsValid() {
+		data = append(data, nlAttr(syscall.RTA_GATEWAY, gw.AsSlice())...)
+	}
+	if dev != "" {
+		index, err := linkIndex(dev)
+		if err != nil {
+			return err
+		}
+		oif := make([]byte, 4)
+		binary.NativeEndian.PutUint32(oif, uint32(index))
+		data = append(data, nlAttr(syscall.RTA_OIF, oif)...)
+	}
+	return netlinkRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, data)
+}
+
 func switchRoot() error {
 	if err := os.Chdir("/bluebox"); err != nil {
 		return err
@@ -114,6 +491,78 @@ func switchRoot() error {
 	return nil
 }
 
+{{- if .Generic}}
+// config holds the parts of the configuration file in the archive, that are used by init.
+type config struct {
+	Version      int
+	ArchiveNodes []string ` + "`json:\"archive_nodes\"`" + `
+	Mounts       []struct {
+		Source, Target, FSType, Data string
+		Flags                        uintptr
+		Perm                         os.FileMode
+	}
+	Nodes []struct {
+		Path string
+		Mode uint32
+		Dev  uint64
+	}
+	Modules []struct {
+		Path, Params string
+	}
+	ModuleErrorsFatal bool ` + "`json:\"module_errors_fatal\"`" + `
+	Links             []struct {
+		Name, Kind, Peer string
+		Addresses        []string
+	}
+	Routes []struct {
+		Dst, Gateway, Dev string
+	}
+}
+
+// readConfig reads the configuration file in the archive. It returns false, if it can not be used.
+func readConfig() (config, bool) {
+	var c config
+	data, err := os.ReadFile("/{{.ConfigFile}}")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[            ]\tFailed to read configuration: %v\n", err)
+		return c, false
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		fmt.Fprintf(os.Stderr, "[            ]\tFailed to decode configuration: %v\n", err)
+		return c, false
+	}
+	if c.Version != {{.ConfigVersion}} {
+		fmt.Fprintf(os.Stderr, "[            ]\tUnsupported version %d of configuration\n", c.Version)
+		return c, false
+	}
+	moduleErrorsFatal = c.ModuleErrorsFatal
+	archiveNodes = c.ArchiveNodes
+	return c, true
+}
+
+// setupEnvironment mounts file systems, creates device nodes, loads kernel modules and configures
+// the network as given in the configuration c. It returns false, if init should stop.
+func setupEnvironment(c config) bool {
+	for _, m := range c.Mounts {
+		mountFS(m.Source, m.Target, m.FSType, m.Flags, m.Data, m.Perm)
+	}
+	for _, n := range c.Nodes {
+		mknod(n.Path, n.Mode, n.Dev)
+	}
+	for _, m := range c.Modules {
+		if !loadModule(m.Path, m.Params) && moduleErrorsFatal {
+			return false
+		}
+	}
+	for _, l := range c.Links {
+		setupLink(l.Name, l.Kind, l.Peer, l.Addresses)
+	}
+	for _, r := range c.Routes {
+		addRoute(r.Dst, r.Gateway, r.Dev)
+	}
+	return true
+}
+{{end}}
 func main() {
 	// Safe guard to make sure this dynamically created executable does not harm the system
 	// when executed by accident.
@@ -130,6 +579,13 @@ func main() {
 		}
 	}()
 
+{{- if .Generic}}
+	// The configuration is read before it is moved to the new root file system.
+	c, ok := readConfig()
+	if !ok {
+		return
+	}
+{{end}}
 	if err := prepareNewRoot(); err != nil {
 		fmt.Fprintf(os.Stderr, "prepareNewRoot: %v\n", err)
 		return
@@ -140,9 +596,16 @@ func main() {
 		return
 	}
 
+{{- if .Generic}}
+	// Create a minimal environment for the Linux kernel as configured in the archive.
+	if !setupEnvironment(c) {
+		return
+	}
+{{- else}}
 	// Create a minimal environment for the Linux kernel
 {{- block "environment" .Environment}}
 {{range .}}{{ print . }}{{end}}
+{{- end}}
 {{- end}}
 
 	// Hand over to new init. This call never returns.
@@ -154,27 +617,87 @@ func main() {
 `
 
 type blueboxTemplateConfig struct {
-	EnvVars     []envVar
-	Executables []string
-	Arguments   [][]string
+	EnvVars         []envVar
+	Executables     []string
+	Arguments       [][]string
+	Timeouts        []time.Duration
+	DebugExitPort   uint16
+	Events          bool
+	Deadline        time.Duration
+	KillDelay       time.Duration
+	StopOnTimeout   bool
+	ArtifactsDir    string
+	ArtifactsDevice string
+	CoverDir        string
+	SendCoverage    bool
+	ConfigFile      string
+	ConfigVersion   int
+	// Cmdline is the parser of the kernel command line from package cmdline.
+	Cmdline string
+	// Generic reads the configuration from the configuration file in the archive instead.
+	Generic bool
 }
 
 var blueboxTemplate string = `package main
 
 import (
+	"archive/tar"
 	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+	"unsafe"
 )
 
 const (
 	// TMPFS_MAGIC from Linux kernel include/uapi/linux/magic.h
 	TMPFS_MAGIC = 0x1021994
+
+	// fileChunkSize is the number of bytes of a file, that are sent with a single file event.
+	fileChunkSize = 3 << 10
+)
+
+var (
+	// debugExitPort is the I/O port of the QEMU isa-debug-exit device. If zero, the result is
+	// not reported through the device.
+	debugExitPort int64 = {{.DebugExitPort}}
+
+	// structured enables the output of framed JSON events instead of human readable lines.
+	structured = {{.Events}}
+
+	// deadline limits the run time of all executables, if not zero.
+	deadline = time.Duration({{printf "%d" .Deadline}})
+
+	// killDelay is the time between SIGTERM and SIGKILL, once a timeout expired.
+	killDelay = time.Duration({{printf "%d" .KillDelay}})
+
+	// stopOnTimeout skips the remaining executables, once the timeout of an executable expired.
+	stopOnTimeout = {{.StopOnTimeout}}
+
+	// artifactsDir is written to artifactsDevice once all executables finished, if not empty.
+	artifactsDir = {{printf "%q" .ArtifactsDir}}
+
+	// artifactsDevice is the raw block device, that receives the artifacts as tar stream.
+	artifactsDevice = {{printf "%q" .ArtifactsDevice}}
+
+	// coverDir is set as GOCOVERDIR for the executables, if not empty.
+	coverDir = {{printf "%q" .CoverDir}}
+
+	// sendCoverage writes the files in coverDir as file events to the console before shutdown.
+	sendCoverage = {{.SendCoverage}}
 )
 
 var envVars [][]string = [][]string{
@@ -192,11 +715,93 @@ var exeArg [][]string = [][]string{
 {{- end}}{{end -}}
 }
 
-func drainPipe(r io.ReadCloser, prefix string, wg *sync.WaitGroup) {
+var exeTimeout []time.Duration = []time.Duration{
+{{block "timeouts" .Timeouts}}{{range .}}{{printf "\t%d,\n" .}}{{end}}{{end -}}
+}
+
+// rusage holds the resources used by an executable.
+type rusage struct {
+	UserTime   int64 ` + "`json:\"utime_us\"`" + `
+	SystemTime int64 ` + "`json:\"stime_us\"`" + `
+	MaxRSS     int64 ` + "`json:\"maxrss_kb\"`" + `
+}
+
+// event is written to the console in structured mode.
+type event struct {
+	Seq      int      ` + "`json:\"seq\"`" + `
+	Type     string   ` + "`json:\"type\"`" + `
+	Time     int64    ` + "`json:\"time_ns\"`" + `
+	Step     int      ` + "`json:\"step,omitempty\"`" + `
+	Name     string   ` + "`json:\"name,omitempty\"`" + `
+	Args     []string ` + "`json:\"args,omitempty\"`" + `
+	Line     string   ` + "`json:\"line,omitempty\"`" + `
+	Status   *int     ` + "`json:\"status,omitempty\"`" + `
+	Signal   string   ` + "`json:\"signal,omitempty\"`" + `
+	Error    string   ` + "`json:\"error,omitempty\"`" + `
+	Duration int64    ` + "`json:\"duration_ns,omitempty\"`" + `
+	Rusage   *rusage  ` + "`json:\"rusage,omitempty\"`" + `
+	Exit     *int     ` + "`json:\"exit,omitempty\"`" + `
+	TimedOut bool     ` + "`json:\"timed_out,omitempty\"`" + `
+	Data     string   ` + "`json:\"data,omitempty\"`" + `
+	Offset   int64    ` + "`json:\"offset,omitempty\"`" + `
+	Size     int64    ` + "`json:\"size,omitempty\"`" + `
+}
+
+var (
+	eventMu  sync.Mutex
+	eventSeq int
+)
+
+// emit writes e as single line to the console. The line starts with a marker followed by the
+// CRC32 of the JSON encoded event, so the host can detect lines that were mixed up with other
+// output.
+func emit(e event) {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	eventSeq++
+	e.Seq = eventSeq
+	e.Time = time.Now().UnixNano()
+	data, err := json.Marshal(e)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[            ]\tFailed to encode event: %v\n", err)
+		return
+	}
+	// Write the frame with a single call to not interleave with other output.
+	os.Stdout.WriteString(fmt.Sprintf("@bluebox %08x %s\n", crc32.ChecksumIEEE(data), data))
+}
+
+// sendFile writes the content of the file at p as file events with the given name to the console.
+// Each event holds a base64 encoded chunk of the file, its offset and the size of the file.
+func sendFile(p, name string) error {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	size := int64(len(data))
+	for offset := int64(0); ; offset += fileChunkSize {
+		chunk := data[offset:min(offset+fileChunkSize, size)]
+		emit(event{
+			Type:   "file",
+			Name:   name,
+			Data:   base64.StdEncoding.EncodeToString(chunk),
+			Offset: offset,
+			Size:   size,
+		})
+		if offset+fileChunkSize >= size {
+			return nil
+		}
+	}
+}
+
+func drainPipe(r io.ReadCloser, step int, prefix string, wg *sync.WaitGroup) {
 	defer r.Close()
 	defer wg.Done()
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
+		if structured {
+			emit(event{Type: prefix + "-line", Step: step, Line: scanner.Text()})
+			continue
+		}
 		fmt.Printf("[            ] %s: %s\n", prefix, scanner.Text())
 	}
 	if err := scanner.Err(); err != nil {
@@ -219,8 +824,278 @@ func preventShutdown() bool {
 	return false
 }
 
+// debugExit writes code to the I/O port of the QEMU isa-debug-exit device, which makes QEMU exit
+// with the status (code << 1) | 1.
+func debugExit(code int) {
+	port, err := os.OpenFile("/dev/port", os.O_WRONLY, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[            ]\tFailed to open /dev/port: %v\n", err)
+		return
+	}
+	defer port.Close()
+	if _, err := port.WriteAt([]byte{byte(code)}, debugExitPort); err != nil {
+		fmt.Fprintf(os.Stderr, "[            ]\tFailed to write to isa-debug-exit: %v\n", err)
+	}
+}
+
+// result describes how an executable finished.
+type result int
+
+const (
+	passed result = iota
+	failed
+	timedOut
+)
+
+// killer terminates the process group of an executable, once its timeout expired.
+type killer struct {
+	mu     sync.Mutex
+	pid    int
+	exited bool
+	// expired is set, once the process group was terminated. It is only valid after stop.
+	expired bool
+	timers  []*time.Timer
+}
+
+// start arms the timeout for the process group pid.
+func (k *killer) start(pid int, timeout time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pid = pid
+	k.timers = append(k.timers, time.AfterFunc(timeout, func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if !k.kill(syscall.SIGTERM) {
+			// The executable exited just before its timeout expired.
+			return
+		}
+		k.expired = true
+		k.timers = append(k.timers, time.AfterFunc(killDelay, func() {
+			k.mu.Lock()
+			defer k.mu.Unlock()
+			k.kill(syscall.SIGKILL)
+		}))
+	}))
+}
+
+// kill sends sig to the process group, if the executable is still running, and reports whether
+// it was sent. k.mu needs to be held.
+func (k *killer) kill(sig syscall.Signal) bool {
+	if k.exited || !running(k.pid) {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "[            ]\tTimeout expired, sending %v to process group %d\n", sig, k.pid)
+	if err := syscall.Kill(-k.pid, sig); err != nil {
+		fmt.Fprintf(os.Stderr, "[            ]\tFailed to send %v: %v\n", sig, err)
+		return false
+	}
+	return true
+}
+
+// running reports whether the child pid did not yet exit. Unlike wait4, the child is not reaped,
+// so it can still be waited for.
+func running(pid int) bool {
+	// siginfo_t of the kernel is 128 bytes. Its first field si_signo is SIGCHLD, if the child
+	// exited, and zero otherwise.
+	var info [128]byte
+	const pPID = 1
+	_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, pPID, uintptr(pid), uintptr(unsafe.Pointer(&info[0])),
+		syscall.WEXITED|syscall.WNOHANG|syscall.WNOWAIT, 0, 0)
+	if errno != 0 {
+		return false
+	}
+	return binary.NativeEndian.Uint32(info[0:4]) == 0
+}
+
+// stop disarms all timers. It needs to be called once the executable was reaped, so its PID can
+// not be reused by another process.
+func (k *killer) stop() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.exited = true
+	for _, t := range k.timers {
+		t.Stop()
+	}
+}
+
+// run executes exe with args as step and reports how it finished. If timeout is not zero, the
+// process group of exe is terminated once it expired.
+func run(step int, exe string, args []string, timeout time.Duration) result {
+	cmd := exec.Command(fmt.Sprintf("./%s", exe), args...)
+	if structured {
+		emit(event{Type: "step-started", Step: step, Name: exe, Args: args})
+	} else {
+		fmt.Printf("[            ]\t%s %s\n", cmd.Path, strings.Join(args, ", "))
+	}
+	start := time.Now()
+
+	// notRun reports that exe could not be run.
+	notRun := func(err error) result {
+		if structured {
+			status := -1
+			emit(event{Type: "step-exited", Step: step, Name: exe, Status: &status, Error: err.Error()})
+		}
+		return failed
+	}
+
+	// Run the executable in its own process group, so it can be terminated with all of its
+	// children.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[            ]\tFailed to redirect stderr for '%s': %v\n", exe, err)
+		return notRun(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[            ]\tFailed to redirect stdout for '%s': %v\n", exe, err)
+		stderr.Close()
+		return notRun(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go drainPipe(stdout, step, "stdout", &wg)
+	go drainPipe(stderr, step, "stderr", &wg)
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "[            ]\tFailure starting %s: %v\n", exe, err)
+		return notRun(err)
+	}
+
+	var k killer
+	if timeout > 0 {
+		k.start(cmd.Process.Pid, timeout)
+	}
+
+	res := failed
+	exited := event{Type: "step-exited", Step: step, Name: exe}
+	for {
+		var s syscall.WaitStatus
+		var r syscall.Rusage
+		p, err := syscall.Wait4(-1, &s, 0, &r)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			k.stop()
+			fmt.Fprintf(os.Stderr, "[            ]\tError from Wait4 for %s: %v\n", cmd.Path, err)
+			exited.Error = fmt.Sprintf("wait4: %v", err)
+			break
+		}
+		if p != cmd.Process.Pid {
+			// As PID 1, bluebox-init inherits the orphaned children of the executables.
+			fmt.Fprintf(os.Stderr, "[            ]\tReaped orphaned PID %d, exit status %d\n", p, s.ExitStatus())
+			continue
+		}
+
+		k.stop()
+		if !structured {
+			fmt.Fprintf(os.Stderr, "[            ]\t%s exited, exit status %d\n", cmd.Path, s.ExitStatus())
+		}
+		if s.Exited() && s.ExitStatus() == 0 {
+			res = passed
+		}
+		if k.expired {
+			if !structured {
+				fmt.Fprintf(os.Stderr, "[            ]\t%s timed out after %v\n", cmd.Path, timeout)
+			}
+			exited.TimedOut = true
+			res = timedOut
+		}
+
+		status := s.ExitStatus()
+		exited.Status = &status
+		if s.Signaled() {
+			exited.Signal = s.Signal().String()
+		}
+		exited.Rusage = &rusage{
+			UserTime:   r.Utime.Nano() / 1000,
+			SystemTime: r.Stime.Nano() / 1000,
+			MaxRSS:     int64(r.Maxrss),
+		}
+		break
+	}
+
+	wg.Wait()
+
+	if structured {
+		// Report the exit once all output of the step was written.
+		exited.Duration = int64(time.Since(start))
+		emit(exited)
+	}
+
+	if err := cmd.Process.Release(); err != nil {
+		fmt.Fprintf(os.Stderr, "[            ]\tError releasing process %v: %v\n", cmd, err)
+	}
+	return res
+}
+
+{{.Cmdline}}
+{{- if .Generic}}
+// loadConfig applies the configuration file in the archive.
+func loadConfig() error {
+	data, err := os.ReadFile("/{{.ConfigFile}}")
+	if err != nil {
+		return err
+	}
+	var c struct {
+		Version int
+		Env     []string
+		Steps   []struct {
+			Path    string
+			Args    []string
+			Timeout time.Duration ` + "`json:\"timeout_ns\"`" + `
+		}
+		DebugExitPort   int64         ` + "`json:\"debug_exit_port\"`" + `
+		Events          bool
+		Deadline        time.Duration ` + "`json:\"deadline_ns\"`" + `
+		KillDelay       time.Duration ` + "`json:\"kill_delay_ns\"`" + `
+		StopOnTimeout   bool          ` + "`json:\"stop_on_timeout\"`" + `
+		ArtifactsDir    string        ` + "`json:\"artifacts_dir\"`" + `
+		ArtifactsDevice string        ` + "`json:\"artifacts_device\"`" + `
+		CoverDir        string        ` + "`json:\"cover_dir\"`" + `
+		SendCoverage    bool          ` + "`json:\"send_coverage\"`" + `
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+	if c.Version != {{.ConfigVersion}} {
+		return fmt.Errorf("unsupported version %d", c.Version)
+	}
+
+	for _, env := range c.Env {
+		k, v, _ := strings.Cut(env, "=")
+		envVars = append(envVars, []string{k, v})
+	}
+	for _, step := range c.Steps {
+		execs = append(execs, step.Path)
+		exeArg = append(exeArg, step.Args)
+		exeTimeout = append(exeTimeout, step.Timeout)
+	}
+	debugExitPort = c.DebugExitPort
+	structured = c.Events
+	deadline = c.Deadline
+	killDelay = c.KillDelay
+	stopOnTimeout = c.StopOnTimeout
+	artifactsDir = c.ArtifactsDir
+	artifactsDevice = c.ArtifactsDevice
+	coverDir = c.CoverDir
+	sendCoverage = c.SendCoverage
+	return nil
+}
+{{end}}
 func main() {
 	noPowerOff := preventShutdown()
+{{- if .Generic}}
+
+	if err := loadConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "[            ]\tFailed to load configuration: %v\n", err)
+		shutdown(noPowerOff, "poweroff", 1)
+		return
+	}
+{{- end}}
 
 	// Set given environment variables
 	for _, vars := range envVars {
@@ -230,62 +1105,278 @@ func main() {
 		}
 	}
 
-	// Execute the testing executables
-	for i, exe := range execs {
-		cmd := exec.Command(fmt.Sprintf("./%s", exe), exeArg[i]...)
-		fmt.Printf("[            ]\t%s %s\n", cmd.Path, strings.Join(exeArg[i], ", "))
-		stderr, err := cmd.StderrPipe()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "[            ]\tFailed to redirect stderr for '%s': %v\n", exe, err)
-			continue
+	// Apply the configuration from the kernel command line.
+	var config cmdline
+	if data, err := os.ReadFile("/proc/cmdline"); err != nil {
+		fmt.Fprintf(os.Stderr, "[            ]\tFailed to read kernel command line: %v\n", err)
+		config = parseCmdline("")
+	} else {
+		config = parseCmdline(string(data))
+	}
+	for _, env := range config.env {
+		k, v, _ := strings.Cut(env, "=")
+		if err := os.Setenv(k, v); err != nil {
+			fmt.Fprintf(os.Stderr, "[            ]\tFailed to set environment variable %s=%s: %v\n", k, v, err)
 		}
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "[            ]\tFailed to redirect stdout for '%s': %v\n", exe, err)
-			stderr.Close()
-			continue
+	}
+	if coverDir != "" {
+		if err := os.MkdirAll(coverDir, 0o755); err != nil {
+			fmt.Fprintf(os.Stderr, "[            ]\tFailed to create coverage directory %s: %v\n", coverDir, err)
+		}
+		if err := os.Setenv("GOCOVERDIR", coverDir); err != nil {
+			fmt.Fprintf(os.Stderr, "[            ]\tFailed to set environment variable GOCOVERDIR=%s: %v\n", coverDir, err)
 		}
+	}
+	if artifactsDir != "" {
+		if err := os.MkdirAll(artifactsDir, 0o755); err != nil {
+			fmt.Fprintf(os.Stderr, "[            ]\tFailed to create artifacts directory %s: %v\n", artifactsDir, err)
+		}
+		if err := os.Setenv("BLUEBOX_ARTIFACTS", artifactsDir); err != nil {
+			fmt.Fprintf(os.Stderr, "[            ]\tFailed to set environment variable BLUEBOX_ARTIFACTS=%s: %v\n", artifactsDir, err)
+		}
+	}
+	selected := config.selected(execs)
+	if config.verbose {
+		fmt.Printf("[            ]\tShutdown action: %s\n", config.shutdown)
+		fmt.Printf("[            ]\tEnvironment: %q\n", os.Environ())
+		for _, i := range selected {
+			fmt.Printf("[            ]\tStep %d: %s %q (timeout %v)\n", i+1, execs[i], config.arguments(execs[i], exeArg[i]), exeTimeout[i])
+		}
+	}
 
-		var wg sync.WaitGroup
-		wg.Add(2)
-		go drainPipe(stdout, "stdout", &wg)
-		go drainPipe(stderr, "stderr", &wg)
+	// Execute the testing executables
+	var steps, passedSteps, failedSteps atomic.Int64
+	// finish reports the aggregated result in a machine-readable form and shuts the VM down. As
+	// the watchdog and main can both finish, only the first call does so.
+	var finishOnce sync.Once
+	exitCode := 0
+	finish := func(failed int64) int {
+		finishOnce.Do(func() {
+			if failed != 0 {
+				exitCode = 1
+			}
+			fmt.Printf("[            ] bluebox-result: steps=%d passed=%d failed=%d exit=%d\n",
+				steps.Load(), passedSteps.Load(), failed, exitCode)
+			shutdown(noPowerOff, config.shutdown, exitCode)
+		})
+		return exitCode
+	}
 
-		if err := cmd.Start(); err != nil {
-			fmt.Fprintf(os.Stderr, "[            ]\tFailure starting %s: %v\n", exe, err)
-			continue
-		}
+	steps.Store(int64(len(selected)))
 
-		for {
-			var s syscall.WaitStatus
-			var r syscall.Rusage
-			if p, err := syscall.Wait4(-1, &s, 0, &r); p == cmd.Process.Pid {
-				fmt.Fprintf(os.Stderr, "[            ]\t%s exited, exit status %d\n", cmd.Path, s.ExitStatus())
-				break
-			} else if p <= 0 {
-				fmt.Fprintf(os.Stderr, "[            ]\tReaped PID %d, exit status %d\n", p, s.ExitStatus())
+	var end time.Time
+	var watchdog *time.Timer
+	if deadline > 0 {
+		end = time.Now().Add(deadline)
+
+		// The watchdog shuts the VM down, if an executable does not exit even after SIGKILL.
+		watchdog = time.AfterFunc(deadline+2*killDelay, func() {
+			fmt.Fprintf(os.Stderr, "[            ]\tWatchdog expired after %v\n", deadline+2*killDelay)
+			code := finish(steps.Load() - passedSteps.Load())
+			// Without a shutdown, main still waits for the executable. So exit instead.
+			os.Exit(code)
+		})
+	}
+
+	// skip reports the selected executables from the n-th on as skipped. They count as failed.
+	skip := func(n int) {
+		for _, i := range selected[n:] {
+			if structured {
+				emit(event{Type: "step-skipped", Step: i + 1, Name: execs[i]})
 				continue
-			} else {
-				fmt.Fprintf(os.Stderr, "[            ]\tError from Wait4 for orphaned child: %v\n", err)
+			}
+			fmt.Printf("[            ]\tSkipping ./%s\n", execs[i])
+		}
+		failedSteps.Add(int64(len(selected) - n))
+	}
+
+	for n, i := range selected {
+		timeout := exeTimeout[i]
+		if !end.IsZero() {
+			remaining := time.Until(end)
+			if remaining <= 0 {
+				fmt.Fprintf(os.Stderr, "[            ]\tDeadline of %v expired, skipping remaining executables\n", deadline)
+				skip(n)
 				break
 			}
+			if timeout == 0 || remaining < timeout {
+				timeout = remaining
+			}
+		}
+
+		start := time.Now()
+		res := run(i+1, execs[i], config.arguments(execs[i], exeArg[i]), timeout)
+		if config.verbose {
+			fmt.Printf("[            ]\tStep %d finished after %v\n", i+1, time.Since(start))
+		}
+		if res == passed {
+			passedSteps.Add(1)
+			continue
+		}
+		failedSteps.Add(1)
+		if res == timedOut && stopOnTimeout && n+1 < len(selected) {
+			fmt.Fprintf(os.Stderr, "[            ]\tSkipping remaining executables after timeout\n")
+			skip(n + 1)
+			break
 		}
+	}
+
+	if watchdog != nil {
+		watchdog.Stop()
+	}
+	finish(failedSteps.Load())
+}
+
+// coverageOnce makes sure the coverage data is sent only once, even if the watchdog expires
+// while it is sent.
+var coverageOnce sync.Once
+
+// sendCoverageFiles writes the files the executables wrote to coverDir as file events to the
+// console.
+func sendCoverageFiles() {
+	entries, err := os.ReadDir(coverDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[            ]\tFailed to read coverage directory: %v\n", err)
+		return
+	}
+	files := 0
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if err := sendFile(filepath.Join(coverDir, entry.Name()), entry.Name()); err != nil {
+			fmt.Fprintf(os.Stderr, "[            ]\tFailed to send coverage file %s: %v\n", entry.Name(), err)
+			continue
+		}
+		files++
+	}
+	if !structured {
+		fmt.Printf("[            ]\tSent %d coverage files\n", files)
+	}
+}
+
+// artifactsOnce makes sure the artifacts are written only once, even if the watchdog expires
+// while they are written.
+var artifactsOnce sync.Once
 
-		wg.Wait()
+// writeArtifacts writes the regular files and directories below artifactsDir as tar stream to
+// artifactsDevice. The end of the stream is marked by the two zero blocks of the tar format.
+func writeArtifacts() {
+	dev, err := os.OpenFile(artifactsDevice, os.O_WRONLY, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[            ]\tFailed to open artifacts device: %v\n", err)
+		return
+	}
+	defer dev.Close()
 
-		if err := cmd.Process.Release(); err != nil {
-			fmt.Fprintf(os.Stderr, "[            ]\tError releasing process %v: %v\n", cmd, err)
+	bw := bufio.NewWriterSize(dev, 1<<20)
+	tw := tar.NewWriter(bw)
+	files := 0
+	err = filepath.WalkDir(artifactsDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(artifactsDir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
 		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			fmt.Fprintf(os.Stderr, "[            ]\tSkipping artifact %s of type %v\n", rel, info.Mode().Type())
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.CopyN(tw, f, hdr.Size); err != nil {
+			return err
+		}
+		files++
+		return nil
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = dev.Sync()
 	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[            ]\tFailed to write artifacts to %s: %v\n", artifactsDevice, err)
+		return
+	}
+	fmt.Printf("[            ]\tWrote %d artifacts to %s\n", files, artifactsDevice)
+}
 
+// shutdown sends the coverage data, writes the artifacts, takes action to stop the VM and hands
+// code to the host, unless noPowerOff is set. action is one of poweroff, reboot, halt or wait.
+func shutdown(noPowerOff bool, action string, code int) {
 	if noPowerOff {
+		if structured {
+			emit(event{Type: "shutdown", Name: "skip", Exit: &code})
+		}
 		fmt.Printf("[            ]\tSkipping shutdown\n")
 		return
 	}
 
+	// Like the shutdown itself, the results are only written in a VM, as the artifacts device
+	// is overwritten.
+	if sendCoverage {
+		coverageOnce.Do(sendCoverageFiles)
+	}
+	if artifactsDir != "" {
+		artifactsOnce.Do(writeArtifacts)
+	}
+
+	if structured {
+		emit(event{Type: "shutdown", Name: action, Exit: &code})
+	}
+
+	if action == "wait" {
+		fmt.Printf("[            ]\tWaiting instead of shutting down\n")
+		for {
+			time.Sleep(time.Hour)
+		}
+	}
+
+	if debugExitPort != 0 {
+		debugExit(code)
+	}
+
 	// Shut VM down
-	if err := syscall.Reboot(syscall.LINUX_REBOOT_CMD_POWER_OFF); err != nil {
-		fmt.Printf("[            ]\tPower off failed: %v\n", err)
+	cmd := syscall.LINUX_REBOOT_CMD_POWER_OFF
+	switch action {
+	case "reboot":
+		cmd = syscall.LINUX_REBOOT_CMD_RESTART
+	case "halt":
+		// LINUX_REBOOT_CMD_HALT does not fit into int on 32-bit architectures, but the kernel
+		// only uses the lower 32 bits.
+		halt := uint32(syscall.LINUX_REBOOT_CMD_HALT)
+		cmd = int(int32(halt))
+	}
+	if err := syscall.Reboot(cmd); err != nil {
+		fmt.Printf("[            ]\tShutdown failed: %v\n", err)
 	}
 }
 `
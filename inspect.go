@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/florianl/bluebox/initramfs"
+)
+
+// inspectFlags returns the flags of the subcommands, that inspect an archive.
+func inspectFlags(name, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "%s\n\nUsage:\n  %s [flags] [archive]\n\n"+
+			"The archive defaults to initramfs.cpio. Use - to read it from stdin.\n\n",
+			description, name)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// openArchive opens the archive given as argument of a subcommand.
+func openArchive(fs *flag.FlagSet) (io.ReadCloser, error) {
+	switch fs.NArg() {
+	case 0:
+		return os.Open("initramfs.cpio")
+	case 1:
+		if fs.Arg(0) == "-" {
+			return io.NopCloser(os.Stdin), nil
+		}
+		return os.Open(fs.Arg(0))
+	default:
+		return nil, fmt.Errorf("expected one archive, got %d", fs.NArg())
+	}
+}
+
+// lsCommand lists the entries of an archive.
+func lsCommand(args []string) error {
+	fs := inspectFlags("ls", "ls lists the entries of an initramfs archive with mode, owner, "+
+		"size or device number and name.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	f, err := openArchive(fs)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var entries []initramfs.Entry
+	if err := initramfs.Walk(f, func(e initramfs.Entry, _ io.Reader) error {
+		entries = append(entries, e)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Only mention segments, if the archive consists of more than a plain cpio archive.
+	segments := len(entries) > 0 && (entries[len(entries)-1].Segment > 0 || entries[0].Compression != "")
+	for i, e := range entries {
+		if segments && (i == 0 || entries[i-1].Segment != e.Segment) {
+			compression := e.Compression
+			if compression == "" {
+				compression = "none"
+			}
+			fmt.Printf("# segment %d, compression %s\n", e.Segment, compression)
+		}
+		size := strconv.FormatInt(e.Size, 10)
+		if e.Mode&os.ModeDevice != 0 {
+			size = fmt.Sprintf("%d, %d", e.Major, e.Minor)
+		}
+		name := e.Name
+		if e.Linkname != "" {
+			name += " -> " + e.Linkname
+		}
+		fmt.Printf("%s %5d %5d %10s %s\n", lsMode(e.Mode), e.Uid, e.Gid, size, name)
+	}
+	return nil
+}
+
+// lsMode formats m like ls -l does.
+func lsMode(m os.FileMode) string {
+	t := "-"
+	switch {
+	case m.IsDir():
+		t = "d"
+	case m&os.ModeSymlink != 0:
+		t = "l"
+	case m&os.ModeCharDevice != 0:
+		t = "c"
+	case m&os.ModeDevice != 0:
+		t = "b"
+	case m&os.ModeNamedPipe != 0:
+		t = "p"
+	case m&os.ModeSocket != 0:
+		t = "s"
+	}
+	return t + m.Perm().String()[1:]
+}
+
+// extractCommand unpacks an archive.
+func extractCommand(args []string) error {
+	var dir string
+
+	fs := inspectFlags("extract", "extract unpacks the directories, regular files and "+
+		"symbolic links of an initramfs archive.")
+	fs.StringVar(&dir, "C", ".", "Directory to extract the archive to.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	f, err := openArchive(fs)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	skipped, err := initramfs.Extract(f, dir)
+	for _, name := range skipped {
+		fmt.Fprintf(os.Stderr, "Skipped %s\n", name)
+	}
+	return err
+}
+
+// configCommand prints the configuration of the init programs in an archive.
+func configCommand(args []string) error {
+	fs := inspectFlags("config", "config prints the configuration of the init programs, "+
+		"that is embedded as bluebox.json in an initramfs archive.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	f, err := openArchive(fs)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	c, err := initramfs.ReadConfig(f)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	return enc.Encode(c)
+}
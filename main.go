@@ -1,37 +1,137 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
+	"maps"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/florianl/bluebox/initramfs"
 )
 
 var (
-	output  string
-	arch    string
-	version bool
+	output        string
+	arch          string
+	compression   string
+	reproducible  bool
+	debugExit     uint
+	events        bool
+	timeout       time.Duration
+	deadline      time.Duration
+	killDelay     time.Duration
+	stopOnTimeout bool
+	moduleFatal   bool
+	moduleDir     string
+	artifacts     string
+	artifactsDev  string
+	cover         bool
+	noCache       bool
+	compile       bool
+	dumpInit      string
+	version       bool
 )
 
 var (
-	execs     []string
-	readOnlys []string
-	args      [][]string
-	env       map[string]string
+	execs         []string
+	execDests     []string
+	readOnlys     []string
+	readOnlyDests []string
+	dirs          []string
+	dirDests      []string
+	includes      []string
+	excludes      []string
+	args          [][]string
+	env           map[string]string
+	mounts        []initramfs.Mount
+	umounts       []string
+	nodes         []device
+	devices       []device
+	modules       []string
+	moduleParams  [][]string
+	modprobes     []string
+	links         []initramfs.Link
+	routes        []initramfs.Route
+	shares        []initramfs.Share
 )
 
 var (
 	executableUsage = "Embed statically linked executable into the archive and execute it once " +
-		"with the resulting init.\nArgument can be specified multiple times.\n\nFormat:\n" +
+		"with the resulting init.\nArgument can be specified multiple times, also for the same " +
+		"executable with different arguments. Executables are run in the given order.\n\nFormat:\n" +
 		"foo:bar\t\t\tWhen foo is executed bar will be the given argument.\n" +
 		"date:+%%s\t\tWhen executed it will print the date as Unix timestamp.\n" +
-		"bazinga:\"-bingo -73\"\tAdd the executable bazinga with the arguments '-bingo' and '-73'."
+		"bazinga:\"-bingo -73\"\tAdd the executable bazinga with the arguments '-bingo' and '-73'.\n" +
+		"foo=bin/foo:bar\t\tPlace foo at bin/foo in the archive and execute it with the argument bar."
 	readOnlyUsage = "Just embed the given file into the archive. The file will not be executed " +
-		"by the resulting init.\nArgument can be specified multiple times."
+		"by the resulting init.\nArgument can be specified multiple times.\n\nFormat:\n" +
+		"foo\t\t\tEmbed foo into the root of the archive.\n" +
+		"foo=testdata/foo\tEmbed foo at testdata/foo in the archive."
+	dirUsage = "Embed the given directory recursively into the archive. Relative paths, file " +
+		"modes, symbolic links and empty directories are kept.\nArgument can be specified " +
+		"multiple times.\n\nFormat:\n" +
+		"testdata\t\tEmbed the directory testdata as testdata into the archive.\n" +
+		"foo=testdata\t\tEmbed the directory foo as testdata into the archive.\n" +
+		"foo=.\t\t\tEmbed the content of the directory foo into the root of the archive."
+	includeUsage = "Only embed files from directories, that match the given glob pattern, and " +
+		"their parent directories.\nArgument can be specified multiple times."
+	excludeUsage = "Skip files and directories from directories, that match the given glob " +
+		"pattern.\nArgument can be specified multiple times."
+	mountUsage = "Mount a file system with the resulting init before the executables are run.\n" +
+		"Argument can be specified multiple times. A mount on the same target replaces the " +
+		"previous one.\n\nFormat:\n" +
+		"cgroup2\t\t\tMount one of the known file systems: " +
+		strings.Join(initramfs.StandardMounts(), ", ") + ".\n" +
+		"tmpfs:/run\t\tMount a tmpfs at /run. A missing target is created.\n" +
+		"tmpfs:/run:nosuid,size=10M\tMount a tmpfs at /run with the given options. Besides " +
+		"ro, nosuid, nodev, noexec, noatime\n\t\t\tand relatime, options are passed as data " +
+		"to the file system."
+	umountUsage = "Do not mount the file system at the given target or of the given known " +
+		"name, e.g. /sys/kernel/debug or debugfs.\nArgument can be specified multiple times " +
+		"and is applied before -mount."
+	mknodUsage = "Create a device node with the resulting init once all file systems are " +
+		"mounted.\nArgument can be specified multiple times.\n\nFormat:\n" +
+		"/dev/net/tun:c:10:200\t\tCreate the character device /dev/net/tun with major 10 and " +
+		"minor 200.\n" +
+		"/dev/loop0:b:7:0:0660\t\tCreate the block device /dev/loop0 with the permissions 0660. " +
+		"By default 0600 is used."
+	mknodArchiveUsage = "Write a device node directly into the archive. Device nodes below /dev " +
+		"are hidden, if devtmpfs is mounted at /dev.\nArgument can be specified multiple times " +
+		"and uses the same format as -mknod."
+	insmodUsage = "Embed the kernel module into the archive and load it with the resulting init " +
+		"before the executables are run.\nArgument can be specified multiple times. Modules are " +
+		"loaded in the given order.\n\nFormat:\n" +
+		"bpf_testmod.ko\t\tLoad the module bpf_testmod.ko.\n" +
+		"foo.ko:\"debug=1 bar=2\"\tLoad the module foo.ko with the parameters 'debug=1' and 'bar=2'."
+	modprobeUsage = "Embed the kernel module of the given name from the modules tree of " +
+		"-module-dir together with its dependencies\nand load them in dependency order with the " +
+		"resulting init.\nArgument can be specified multiple times."
+	netUsage = "Configure a network interface with the resulting init before the executables " +
+		"are run.\nArgument can be specified multiple times.\n\nFormat:\n" +
+		"lo\t\t\tBring the loopback interface up.\n" +
+		"eth0=10.0.2.15/24\tAssign the address 10.0.2.15/24 to eth0 and bring it up.\n" +
+		"dummy0:dummy=10.1.0.1/24\tCreate the dummy interface dummy0 with the given address.\n" +
+		"veth0:veth:veth1=10.2.0.1/24,fd00::1/64\n\t\t\tCreate the veth pair veth0 and veth1 " +
+		"and assign the given addresses to veth0."
+	routeUsage = "Add a route with the resulting init once all network interfaces are " +
+		"configured.\nArgument can be specified multiple times.\n\nFormat:\n" +
+		"\"default via 10.0.2.2\"\t\tAdd a default route via the gateway 10.0.2.2.\n" +
+		"\"10.3.0.0/16 via 10.2.0.2 dev veth0\"\tAdd a route via the gateway on veth0.\n" +
+		"\"10.4.0.0/16 dev veth0\"\t\tAdd a route to a directly connected network."
+	shareUsage = "Mount a directory shared by the host with 9p or virtiofs with the resulting " +
+		"init.\nArgument can be specified multiple times. Use -share or -virtiofs of the run " +
+		"command to share the directory.\n\nFormat:\n" +
+		"testdata:/testdata\t\tMount the 9p share with the tag testdata at /testdata.\n" +
+		"results:/results:virtiofs\tMount the virtiofs share with the tag results at /results.\n" +
+		"testdata:/testdata:9p,ro\tMount the 9p share read-only."
 	envVarUsage = "Set environment variable.\n\nFormat:\nfoo=bar\n" +
 		"Argument can be specified multiple times."
 )
@@ -40,23 +140,101 @@ func init() {
 	flag.StringVar(&output, "o", "initramfs.cpio", "Define the name of the output file.")
 	flag.StringVar(&arch, "a", "", "Target architecture of the resulting archive. All values "+
 		"that are accepted by GOARCH are possible.\nBy default the host architecture is used.")
+	flag.StringVar(&compression, "z", "none", "Compress the resulting archive. Possible values are "+
+		strings.Join(initramfs.Compressors(), ", ")+" and none.\nExcept for gzip, the compression "+
+		"requires the respective program to be installed.")
+	flag.BoolVar(&reproducible, "reproducible", false, "Create a byte-identical archive for the "+
+		"same input.\nThe modification time of all entries is taken from SOURCE_DATE_EPOCH.")
+	flag.UintVar(&debugExit, "debug-exit", 0, "Report the result of the executables to the QEMU "+
+		"isa-debug-exit device at the given I/O port, e.g. 0xf4.\nQEMU then exits with the status "+
+		"(result << 1) | 1. Only supported on amd64 and 386.")
+	flag.BoolVar(&events, "events", false, "Write framed JSON events instead of human readable "+
+		"lines for the embedded executables to the console.")
+	flag.DurationVar(&timeout, "timeout", 0, "Terminate each embedded executable, that runs "+
+		"longer than the given duration, e.g. 2m.\nBy default executables are not limited.")
+	flag.DurationVar(&deadline, "deadline", 0, "Terminate the embedded executables, once the "+
+		"given duration since the start of the first one expired.\nThe remaining executables "+
+		"are skipped. By default there is no deadline.")
+	flag.DurationVar(&killDelay, "kill-delay", 5*time.Second, "Time between sending SIGTERM "+
+		"and SIGKILL to the process group of an executable, once its timeout expired.")
+	flag.BoolVar(&stopOnTimeout, "stop-on-timeout", false, "Skip the remaining executables, "+
+		"once the timeout of an executable expired.")
 	flag.Func("e", executableUsage, embedExec)
 	flag.Func("r", readOnlyUsage, embedFile)
+	flag.Func("R", dirUsage, embedDir)
+	flag.Func("include", includeUsage, appendTo(&includes))
+	flag.Func("exclude", excludeUsage, appendTo(&excludes))
+	flag.Func("mount", mountUsage, addMount)
+	flag.Func("umount", umountUsage, appendTo(&umounts))
+	flag.Func("mknod", mknodUsage, addDevice(&nodes))
+	flag.Func("mknod-archive", mknodArchiveUsage, addDevice(&devices))
+	flag.Func("insmod", insmodUsage, addModule)
+	flag.StringVar(&moduleDir, "module-dir", "", "Modules tree of the kernel, e.g. "+
+		"/lib/modules/6.12.0, to take the modules of -modprobe from.")
+	flag.Func("modprobe", modprobeUsage, appendTo(&modprobes))
+	flag.BoolVar(&moduleFatal, "module-errors-fatal", false, "Do not run the embedded "+
+		"executables and shut down, if a kernel module can not be loaded.")
+	flag.Func("net", netUsage, addLink)
+	flag.Func("route", routeUsage, addRoute)
+	flag.Func("share", shareUsage, addShare)
+	flag.StringVar(&artifacts, "artifacts", "", "Directory in the guest, e.g. /artifacts, that "+
+		"is written as tar stream to -artifacts-device\nonce all executables finished. Use "+
+		"-artifacts of the run command to collect the files.")
+	flag.StringVar(&artifactsDev, "artifacts-device", "/dev/vda", "Raw block device in the "+
+		"guest, that receives the files of -artifacts.")
+	flag.BoolVar(&cover, "cover", false, "Set GOCOVERDIR for the embedded executables and "+
+		"collect the coverage data once all executables finished.\nThe files are written to "+
+		"the subdirectory coverage of -artifacts or, without it, to the console.\nUse -coverdir "+
+		"of the run command to extract them from the console.")
+	flag.BoolVar(&noCache, "no-cache", false, "Always compile the init programs instead of "+
+		"taking them from the build cache.\nUse the cache command to inspect the build cache.")
+	flag.BoolVar(&compile, "compile", false, "Compile the init programs with the configuration "+
+		"built in instead of using the prebuilt ones,\nthat read it from bluebox.json. "+
+		"Requires a Go toolchain.")
+	flag.StringVar(&dumpInit, "dump-init", "", "Write the Go sources of init and bluebox-init, "+
+		"bluebox.json and build.sh,\nthat compiles them, to the given directory instead of "+
+		"creating the archive.")
 	flag.Func("v", envVarUsage, embedEnvVar)
 	flag.BoolVar(&version, "version", false, "Print revision of this bluebox executable and return.")
 
 	env = make(map[string]string)
 }
 
+// commands maps subcommands to their implementation. Each implementation gets the arguments
+// following the name of the subcommand.
+var commands = map[string]func(args []string) error{
+	"run":     runCommand,
+	"report":  reportCommand,
+	"cache":   cacheCommand,
+	"ls":      lsCommand,
+	"extract": extractCommand,
+	"config":  configCommand,
+	"diff":    diffCommand,
+}
+
 func usage() {
 	cmd := filepath.Base(os.Args[0])
 	fmt.Printf("%s creates a bootable initramfs, that will embed the given statically "+
 		"linked executables.\n\n", cmd)
+	fmt.Printf("Usage:\n  %s [flags]\n  %s run [flags] [-- qemu arguments]\n  %s report [flags] [console log]\n"+
+		"  %s cache [flags] [dir|list|prune]\n  %s ls|extract|config [flags] [archive]\n"+
+		"  %s diff [flags] old-archive new-archive\n\n", cmd, cmd, cmd, cmd, cmd, cmd)
 	flag.PrintDefaults()
 }
 
+// exitCode is returned by subcommands to exit with a specific code.
+type exitCode int
+
+func (e exitCode) Error() string {
+	return fmt.Sprintf("exit code %d", int(e))
+}
+
 // fail print the error to stderr and calls exit.
 func fail(err error) {
+	var code exitCode
+	if errors.As(err, &code) {
+		os.Exit(int(code))
+	}
 	fmt.Fprintf(os.Stderr, "%s\n", err)
 	os.Exit(1)
 }
@@ -80,6 +258,15 @@ func showVersion() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fail(err)
+			}
+			return
+		}
+	}
+
 	flag.Usage = usage
 	flag.Parse()
 
@@ -91,13 +278,98 @@ func main() {
 	bluebox := initramfs.New()
 
 	for i := range execs {
-		if err := bluebox.Execute(execs[i], args[i]...); err != nil {
+		if err := bluebox.AddStep(initramfs.Step{
+			Executable: execs[i],
+			Dest:       execDests[i],
+			Args:       args[i],
+			Timeout:    timeout,
+		}); err != nil {
 			fail(err)
 		}
 	}
 
-	for _, file := range readOnlys {
-		if err := bluebox.Embed(file); err != nil {
+	for i, file := range readOnlys {
+		var err error
+		if readOnlyDests[i] == "" {
+			err = bluebox.Embed(file)
+		} else {
+			err = bluebox.EmbedAs(file, readOnlyDests[i])
+		}
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	for i, dir := range dirs {
+		dst := dirDests[i]
+		if dst == "" {
+			dst = filepath.Base(dir)
+		}
+		if err := bluebox.EmbedDir(dir, dst, includes, excludes); err != nil {
+			fail(err)
+		}
+	}
+
+	for _, target := range umounts {
+		if !strings.HasPrefix(target, "/") {
+			m, err := initramfs.MountByName(target)
+			if err != nil {
+				fail(err)
+			}
+			target = m.Target
+		}
+		if err := bluebox.RemoveMount(target); err != nil {
+			fail(err)
+		}
+	}
+
+	for _, m := range mounts {
+		if err := bluebox.AddMount(m); err != nil {
+			fail(err)
+		}
+	}
+
+	for _, d := range nodes {
+		if err := bluebox.Mknod(d.path, d.typ, d.major, d.minor, d.perm); err != nil {
+			fail(err)
+		}
+	}
+
+	for _, d := range devices {
+		if err := bluebox.EmbedDevice(d.path, d.typ, d.major, d.minor, d.perm); err != nil {
+			fail(err)
+		}
+	}
+
+	for i, module := range modules {
+		if err := bluebox.LoadModule(module, moduleParams[i]...); err != nil {
+			fail(err)
+		}
+	}
+	if len(modprobes) != 0 {
+		if moduleDir == "" {
+			fail(errors.New("-modprobe requires -module-dir"))
+		}
+		if err := bluebox.LoadModulesFrom(moduleDir, modprobes...); err != nil {
+			fail(err)
+		}
+	}
+	bluebox.SetModuleErrorsFatal(moduleFatal)
+
+	for _, l := range links {
+		if err := bluebox.AddLink(l); err != nil {
+			fail(err)
+		}
+	}
+
+	for _, r := range routes {
+		if err := bluebox.AddRoute(r); err != nil {
+			fail(err)
+		}
+	}
+
+	for _, share := range shares {
+		if err := bluebox.AddShare(share); err != nil {
 			fail(err)
 		}
 	}
@@ -108,11 +380,43 @@ func main() {
 		}
 	}
 
-	for k, v := range env {
-		bluebox.Setenv(k, v)
+	compressor, err := initramfs.CompressorByName(compression)
+	if err != nil {
+		fail(err)
+	}
+	bluebox.SetCompressor(compressor)
+	bluebox.SetReproducible(reproducible)
+
+	if debugExit > math.MaxUint16 {
+		fail(fmt.Errorf("invalid I/O port 0x%x for isa-debug-exit", debugExit))
+	}
+	bluebox.SetDebugExit(uint16(debugExit))
+	bluebox.SetEventStream(events)
+	bluebox.SetDeadline(deadline)
+	bluebox.SetKillDelay(killDelay)
+	bluebox.SetStopOnTimeout(stopOnTimeout)
+	if err := bluebox.SetArtifacts(artifacts, artifactsDev); err != nil {
+		fail(err)
+	}
+	bluebox.SetCoverage(cover)
+	if noCache {
+		bluebox.SetCacheDir("")
+	}
+	bluebox.SetPrebuilt(!compile)
+
+	// Iterate over the sorted keys to get the same init for the same command line.
+	for _, k := range slices.Sorted(maps.Keys(env)) {
+		bluebox.Setenv(k, env[k])
 	}
 
-	archive, err := os.OpenFile(output, os.O_CREATE|os.O_RDWR, 0o644)
+	if dumpInit != "" {
+		if err := bluebox.DumpInit(dumpInit); err != nil {
+			fail(err)
+		}
+		return
+	}
+
+	archive, err := os.OpenFile(output, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o644)
 	if err != nil {
 		fail(err)
 	}
@@ -126,17 +430,19 @@ func main() {
 // foo:bar
 // foo:"-v -bar"
 // foo
+// foo=bin/foo:bar
 func embedExec(arg string) error {
 	if len(arg) == 0 {
 		return nil
 	}
 	split := strings.SplitN(arg, ":", 2)
 
-	cmd := split[0]
+	cmd, dst := splitDest(split[0])
 	if cmd == "init" || cmd == "bluebox-init" || cmd == "bluebox" {
 		return fmt.Errorf("embedded executable should not be named '%s'", cmd)
 	}
 	execs = append(execs, cmd)
+	execDests = append(execDests, dst)
 
 	if len(split) == 1 {
 		args = append(args, []string{})
@@ -148,11 +454,230 @@ func embedExec(arg string) error {
 	return nil
 }
 
-func embedFile(file string) error {
+// Examples:
+// foo
+// foo=testdata/foo
+func embedFile(arg string) error {
+	file, dst := splitDest(arg)
 	readOnlys = append(readOnlys, file)
+	readOnlyDests = append(readOnlyDests, dst)
+	return nil
+}
+
+// Examples:
+// testdata
+// foo=testdata
+func embedDir(arg string) error {
+	dir, dst := splitDest(arg)
+	dirs = append(dirs, dir)
+	dirDests = append(dirDests, dst)
 	return nil
 }
 
+// appendTo returns a function that appends its argument to list.
+func appendTo(list *[]string) func(string) error {
+	return func(arg string) error {
+		*list = append(*list, arg)
+		return nil
+	}
+}
+
+// splitDest splits arg of the format src=dst. If arg does not specify a destination, dst is empty.
+func splitDest(arg string) (src, dst string) {
+	src, dst, _ = strings.Cut(arg, "=")
+	return src, dst
+}
+
+// mountFlags maps options of mount(8) to their flags.
+var mountFlags = map[string]uintptr{
+	"ro":       initramfs.MountReadOnly,
+	"nosuid":   initramfs.MountNoSuid,
+	"nodev":    initramfs.MountNoDev,
+	"noexec":   initramfs.MountNoExec,
+	"noatime":  initramfs.MountNoAtime,
+	"relatime": initramfs.MountRelatime,
+}
+
+// Examples:
+// cgroup2
+// tmpfs:/run
+// tmpfs:/run:nosuid,size=10M
+func addMount(arg string) error {
+	split := strings.SplitN(arg, ":", 3)
+	if len(split) == 1 {
+		m, err := initramfs.MountByName(arg)
+		if err != nil {
+			return err
+		}
+		mounts = append(mounts, m)
+		return nil
+	}
+
+	m := initramfs.Mount{
+		FSType: split[0],
+		Target: split[1],
+		Perm:   0o755,
+	}
+	if len(split) == 3 {
+		var data []string
+		for _, option := range strings.Split(split[2], ",") {
+			if f, ok := mountFlags[option]; ok {
+				m.Flags |= f
+				continue
+			}
+			data = append(data, option)
+		}
+		m.Data = strings.Join(data, ",")
+	}
+	mounts = append(mounts, m)
+	return nil
+}
+
+// Examples:
+// bpf_testmod.ko
+// foo.ko:"debug=1 bar=2"
+func addModule(arg string) error {
+	module, params, ok := strings.Cut(arg, ":")
+	modules = append(modules, module)
+	if !ok {
+		moduleParams = append(moduleParams, nil)
+		return nil
+	}
+	moduleParams = append(moduleParams, strings.Fields(strings.Trim(params, "\"")))
+	return nil
+}
+
+// Examples:
+// lo
+// eth0=10.0.2.15/24
+// dummy0:dummy=10.1.0.1/24
+// veth0:veth:veth1=10.2.0.1/24,fd00::1/64
+func addLink(arg string) error {
+	link, addrs, _ := strings.Cut(arg, "=")
+	split := strings.Split(link, ":")
+	if len(split) > 3 {
+		return fmt.Errorf("invalid network interface '%s'", arg)
+	}
+
+	l := initramfs.Link{Name: split[0]}
+	if len(split) > 1 {
+		l.Kind = split[1]
+	}
+	if len(split) > 2 {
+		l.Peer = split[2]
+	}
+	if addrs != "" {
+		l.Addresses = strings.Split(addrs, ",")
+	}
+	links = append(links, l)
+	return nil
+}
+
+// Examples:
+// default via 10.0.2.2
+// 10.3.0.0/16 via 10.2.0.2 dev veth0
+// 10.4.0.0/16 dev veth0
+func addRoute(arg string) error {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return fmt.Errorf("invalid route '%s'", arg)
+	}
+
+	r := initramfs.Route{Dst: fields[0]}
+	for i := 1; i < len(fields); i += 2 {
+		if i+1 == len(fields) {
+			return fmt.Errorf("missing value for '%s' of route '%s'", fields[i], arg)
+		}
+		switch fields[i] {
+		case "via":
+			r.Gateway = fields[i+1]
+		case "dev":
+			r.Dev = fields[i+1]
+		default:
+			return fmt.Errorf("unsupported option '%s' of route '%s'", fields[i], arg)
+		}
+	}
+	routes = append(routes, r)
+	return nil
+}
+
+// Examples:
+// testdata:/testdata
+// results:/results:virtiofs
+// testdata:/testdata:9p,ro
+func addShare(arg string) error {
+	split := strings.SplitN(arg, ":", 3)
+	if len(split) < 2 {
+		return fmt.Errorf("invalid share '%s'", arg)
+	}
+
+	share := initramfs.Share{Tag: split[0], Target: split[1]}
+	if len(split) == 3 {
+		for _, option := range strings.Split(split[2], ",") {
+			switch option {
+			case "ro":
+				share.ReadOnly = true
+			case "9p", "virtiofs":
+				share.FSType = option
+			default:
+				return fmt.Errorf("unsupported option '%s' of share '%s'", option, arg)
+			}
+		}
+	}
+	shares = append(shares, share)
+	return nil
+}
+
+// device describes a device node given on the command line.
+type device struct {
+	path         string
+	typ          initramfs.DeviceType
+	major, minor uint32
+	perm         fs.FileMode
+}
+
+// addDevice returns a function that appends the device node of its argument to list.
+//
+// Examples:
+// /dev/net/tun:c:10:200
+// /dev/loop0:b:7:0:0660
+func addDevice(list *[]device) func(string) error {
+	return func(arg string) error {
+		split := strings.Split(arg, ":")
+		if len(split) != 4 && len(split) != 5 {
+			return fmt.Errorf("invalid device node '%s'", arg)
+		}
+
+		d := device{path: split[0], perm: 0o600}
+		switch split[1] {
+		case "c":
+			d.typ = initramfs.CharDevice
+		case "b":
+			d.typ = initramfs.BlockDevice
+		default:
+			return fmt.Errorf("invalid device type '%s' of '%s'", split[1], arg)
+		}
+		major, err := strconv.ParseUint(split[2], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid major number of '%s': %v", arg, err)
+		}
+		minor, err := strconv.ParseUint(split[3], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid minor number of '%s': %v", arg, err)
+		}
+		d.major, d.minor = uint32(major), uint32(minor)
+		if len(split) == 5 {
+			perm, err := strconv.ParseUint(split[4], 8, 32)
+			if err != nil || perm > 0o777 {
+				return fmt.Errorf("invalid permissions of '%s'", arg)
+			}
+			d.perm = fs.FileMode(perm)
+		}
+		*list = append(*list, d)
+		return nil
+	}
+}
+
 func embedEnvVar(arg string) error {
 	if len(arg) == 0 {
 		return nil
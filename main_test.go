@@ -3,17 +3,21 @@ package main
 import (
 	"reflect"
 	"testing"
+
+	"github.com/florianl/bluebox/initramfs"
 )
 
 func TestEmbedExec(t *testing.T) {
 	tests := map[string]struct {
 		input string
 		execs []string
+		dests []string
 		args  [][]string
 	}{
 		"no input": {
 			input: "",
 			execs: []string{},
+			dests: []string{},
 			args:  [][]string{},
 		},
 		"with argument input": {
@@ -21,6 +25,7 @@ func TestEmbedExec(t *testing.T) {
 			execs: []string{
 				"foo",
 			},
+			dests: []string{""},
 			args: [][]string{
 				{"bar"},
 			},
@@ -30,6 +35,7 @@ func TestEmbedExec(t *testing.T) {
 			execs: []string{
 				"go",
 			},
+			dests: []string{""},
 			args: [][]string{
 				{"-123", "-456", "-789"},
 			},
@@ -39,16 +45,28 @@ func TestEmbedExec(t *testing.T) {
 			execs: []string{
 				"bazinga",
 			},
+			dests: []string{""},
 			args: [][]string{
 				{},
 			},
 		},
+		"with destination": {
+			input: `foo=bin/foo:"-v"`,
+			execs: []string{
+				"foo",
+			},
+			dests: []string{"bin/foo"},
+			args: [][]string{
+				{"-v"},
+			},
+		},
 	}
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
 			// Reset package global variables
 			execs = []string{}
+			execDests = []string{}
 			args = [][]string{}
 
 			if err := embedExec(tc.input); err != nil {
@@ -58,6 +76,10 @@ func TestEmbedExec(t *testing.T) {
 				t.Fatalf("expected executables did not match. "+
 					"Got: %#v\nExpected: %#v", execs, tc.execs)
 			}
+			if !reflect.DeepEqual(execDests, tc.dests) {
+				t.Fatalf("expected destinations did not match. "+
+					"Got: %#v\nExpected: %#v", execDests, tc.dests)
+			}
 			if !reflect.DeepEqual(args, tc.args) {
 				t.Fatalf("expected arguments did not match. "+
 					"Got: %#v\nExpected: %#v", args, tc.args)
@@ -106,3 +128,234 @@ func TestEmbedEnvVar(t *testing.T) {
 		})
 	}
 }
+
+func TestAddMount(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		mounts []initramfs.Mount
+		err    bool
+	}{
+		"known name": {
+			input: "tracefs",
+			mounts: []initramfs.Mount{
+				{Source: "tracefs", Target: "/sys/kernel/tracing", FSType: "tracefs"},
+			},
+		},
+		"unknown name": {
+			input: "foofs",
+			err:   true,
+		},
+		"without options": {
+			input: "tmpfs:/run",
+			mounts: []initramfs.Mount{
+				{Target: "/run", FSType: "tmpfs", Perm: 0o755},
+			},
+		},
+		"with options": {
+			input: "tmpfs:/run:nosuid,size=10M,nodev,mode=0755",
+			mounts: []initramfs.Mount{
+				{
+					Target: "/run", FSType: "tmpfs", Data: "size=10M,mode=0755", Perm: 0o755,
+					Flags: initramfs.MountNoSuid | initramfs.MountNoDev,
+				},
+			},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Reset package global variables
+			mounts = nil
+
+			err := addMount(tc.input)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+			if !reflect.DeepEqual(mounts, tc.mounts) {
+				t.Fatalf("expected mounts did not match. "+
+					"Got: %#v\nExpected: %#v", mounts, tc.mounts)
+			}
+		})
+	}
+}
+
+func TestAddDevice(t *testing.T) {
+	tests := map[string]struct {
+		input   string
+		devices []device
+		err     bool
+	}{
+		"character device": {
+			input:   "/dev/net/tun:c:10:200",
+			devices: []device{{path: "/dev/net/tun", typ: initramfs.CharDevice, major: 10, minor: 200, perm: 0o600}},
+		},
+		"block device with permissions": {
+			input:   "/dev/loop0:b:7:0:0660",
+			devices: []device{{path: "/dev/loop0", typ: initramfs.BlockDevice, major: 7, perm: 0o660}},
+		},
+		"invalid type": {
+			input: "/dev/loop0:x:7:0",
+			err:   true,
+		},
+		"missing minor": {
+			input: "/dev/loop0:b:7",
+			err:   true,
+		},
+		"invalid permissions": {
+			input: "/dev/loop0:b:7:0:999",
+			err:   true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var devices []device
+			err := addDevice(&devices)(tc.input)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+			if !reflect.DeepEqual(devices, tc.devices) {
+				t.Fatalf("expected devices did not match. "+
+					"Got: %#v\nExpected: %#v", devices, tc.devices)
+			}
+		})
+	}
+}
+
+func TestAddModule(t *testing.T) {
+	// Reset package global variables
+	modules = nil
+	moduleParams = nil
+
+	for _, arg := range []string{"bpf_testmod.ko", `foo.ko:"debug=1 bar=2"`} {
+		if err := addModule(arg); err != nil {
+			t.Fatalf("expected no error but got: %v", err)
+		}
+	}
+
+	expectedModules := []string{"bpf_testmod.ko", "foo.ko"}
+	if !reflect.DeepEqual(modules, expectedModules) {
+		t.Fatalf("expected modules did not match. "+
+			"Got: %#v\nExpected: %#v", modules, expectedModules)
+	}
+	expectedParams := [][]string{nil, {"debug=1", "bar=2"}}
+	if !reflect.DeepEqual(moduleParams, expectedParams) {
+		t.Fatalf("expected module parameters did not match. "+
+			"Got: %#v\nExpected: %#v", moduleParams, expectedParams)
+	}
+}
+
+func TestAddLink(t *testing.T) {
+	// Reset package global variables
+	links = nil
+
+	for _, arg := range []string{"lo", "eth0=10.0.2.15/24", "veth0:veth:veth1=10.2.0.1/24,fd00::1/64"} {
+		if err := addLink(arg); err != nil {
+			t.Fatalf("expected no error but got: %v", err)
+		}
+	}
+	if err := addLink("a:b:c:d"); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	expected := []initramfs.Link{
+		{Name: "lo"},
+		{Name: "eth0", Addresses: []string{"10.0.2.15/24"}},
+		{Name: "veth0", Kind: "veth", Peer: "veth1", Addresses: []string{"10.2.0.1/24", "fd00::1/64"}},
+	}
+	if !reflect.DeepEqual(links, expected) {
+		t.Fatalf("expected network interfaces did not match. "+
+			"Got: %#v\nExpected: %#v", links, expected)
+	}
+}
+
+func TestAddRoute(t *testing.T) {
+	tests := map[string]struct {
+		input string
+		route initramfs.Route
+		err   bool
+	}{
+		"default route": {
+			input: "default via 10.0.2.2",
+			route: initramfs.Route{Dst: "default", Gateway: "10.0.2.2"},
+		},
+		"with device": {
+			input: "10.3.0.0/16 via 10.2.0.2 dev veth0",
+			route: initramfs.Route{Dst: "10.3.0.0/16", Gateway: "10.2.0.2", Dev: "veth0"},
+		},
+		"missing value": {
+			input: "10.4.0.0/16 dev",
+			err:   true,
+		},
+		"unsupported option": {
+			input: "10.4.0.0/16 metric 10",
+			err:   true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Reset package global variables
+			routes = nil
+
+			err := addRoute(tc.input)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+			if !reflect.DeepEqual(routes, []initramfs.Route{tc.route}) {
+				t.Fatalf("expected route did not match. "+
+					"Got: %#v\nExpected: %#v", routes, tc.route)
+			}
+		})
+	}
+}
+
+func TestAddShare(t *testing.T) {
+	// Reset package global variables
+	shares = nil
+
+	for _, arg := range []string{"testdata:/testdata", "results:/results:virtiofs", "data:/data:9p,ro"} {
+		if err := addShare(arg); err != nil {
+			t.Fatalf("expected no error but got: %v", err)
+		}
+	}
+	for _, arg := range []string{"testdata", "data:/data:nfs"} {
+		if err := addShare(arg); err == nil {
+			t.Fatalf("expected an error for '%s'", arg)
+		}
+	}
+
+	expected := []initramfs.Share{
+		{Tag: "testdata", Target: "/testdata"},
+		{Tag: "results", Target: "/results", FSType: "virtiofs"},
+		{Tag: "data", Target: "/data", FSType: "9p", ReadOnly: true},
+	}
+	if !reflect.DeepEqual(shares, expected) {
+		t.Fatalf("expected shares did not match. "+
+			"Got: %#v\nExpected: %#v", shares, expected)
+	}
+}
+
+func TestDiffCommand(t *testing.T) {
+	if err := diffCommand([]string{"-", "-"}); err == nil {
+		t.Fatal("expected an error for reading both archives from stdin")
+	}
+	if err := diffCommand([]string{"-"}); err == nil {
+		t.Fatal("expected an error for a single archive")
+	}
+}
@@ -0,0 +1,258 @@
+// Package qemu boots a Linux kernel with an initramfs archive, that was generated by bluebox, in a
+// virtual machine provided by QEMU.
+package qemu
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+
+	"github.com/florianl/bluebox/initramfs"
+	exec "golang.org/x/sys/execabs"
+)
+
+// machine describes how QEMU emulates a specific architecture.
+type machine struct {
+	// binary is the name of the QEMU executable.
+	binary string
+	// args holds arguments that select machine type and CPU.
+	args []string
+	// console is the name of the serial console device in the guest.
+	console string
+	// nic is the model of the virtio-net device. By default virtio-net-pci is used.
+	nic string
+}
+
+// machines maps GOARCH values to their QEMU machine.
+var machines = map[string]machine{
+	"386":     {binary: "qemu-system-i386", console: "ttyS0"},
+	"amd64":   {binary: "qemu-system-x86_64", console: "ttyS0"},
+	"arm":     {binary: "qemu-system-arm", args: []string{"-M", "virt"}, console: "ttyAMA0"},
+	"arm64":   {binary: "qemu-system-aarch64", args: []string{"-M", "virt", "-cpu", "cortex-a72"}, console: "ttyAMA0"},
+	"loong64": {binary: "qemu-system-loongarch64", args: []string{"-M", "virt"}, console: "ttyS0"},
+	"ppc64le": {binary: "qemu-system-ppc64", args: []string{"-M", "pseries"}, console: "hvc0"},
+	"riscv64": {binary: "qemu-system-riscv64", args: []string{"-M", "virt"}, console: "ttyS0"},
+	"s390x":   {binary: "qemu-system-s390x", console: "ttysclp0", nic: "virtio-net-ccw"},
+}
+
+// Share describes a directory of the host, that is shared with the guest. In the guest it can be
+// mounted with the file system type 9p or, if Socket is set, virtiofs and Tag as source.
+type Share struct {
+	// Tag identifies the share in the guest.
+	Tag string
+	// Path is the directory on the host, that is shared with 9p.
+	Path string
+	// Socket is the path to the vhost-user socket of a running virtiofsd. If set, the share
+	// uses virtiofs and Path is ignored.
+	Socket string
+	// ReadOnly prevents the guest from writing to a share with 9p.
+	ReadOnly bool
+}
+
+// Config describes the virtual machine.
+type Config struct {
+	// Arch is the GOARCH value of the kernel and the archive. By default the architecture of
+	// the host is used.
+	Arch string
+	// Kernel is the path to the kernel image.
+	Kernel string
+	// Initrd is the path to the initramfs archive.
+	Initrd string
+	// Memory is the amount of memory of the virtual machine, e.g. 2G. By default 2G are used.
+	Memory string
+	// Append holds additional parameters for the kernel command line.
+	Append string
+	// Binary is the QEMU executable. By default qemu-system-* for Arch is used.
+	Binary string
+	// KVM enables hardware acceleration. Arch has to match the architecture of the host.
+	KVM bool
+	// DebugExitPort is the I/O port of the isa-debug-exit device. It needs to match the port
+	// the archive was generated with. If zero, no isa-debug-exit device is added.
+	DebugExitPort uint16
+	// Network adds a virtio-net device with user mode networking. In the guest the network
+	// interface eth0 can then use the address 10.0.2.15/24 and the gateway 10.0.2.2.
+	Network bool
+	// Shares holds directories of the host, that are shared with the guest.
+	Shares []Share
+	// Disks holds raw disk images, that are added as virtio block devices. In the guest they
+	// are available in the given order as /dev/vda, /dev/vdb and so on.
+	Disks []string
+	// Args holds additional arguments that are passed to QEMU.
+	Args []string
+}
+
+// Command returns the QEMU executable and its arguments for the virtual machine.
+func (c Config) Command() (string, []string, error) {
+	arch := c.Arch
+	if arch == "" {
+		arch = runtime.GOARCH
+	}
+	m, ok := machines[arch]
+	if !ok {
+		return "", nil, fmt.Errorf("unsupported architecture '%s'", arch)
+	}
+	if c.Kernel == "" {
+		return "", nil, errors.New("no kernel image given")
+	}
+	if c.Initrd == "" {
+		return "", nil, errors.New("no initramfs archive given")
+	}
+	if c.DebugExitPort != 0 && arch != "amd64" && arch != "386" {
+		return "", nil, fmt.Errorf("isa-debug-exit is not supported on %s", arch)
+	}
+
+	binary := c.Binary
+	if binary == "" {
+		binary = m.binary
+	}
+	memory := c.Memory
+	if memory == "" {
+		memory = "2G"
+	}
+
+	// Kernel panics should terminate QEMU instead of rebooting the virtual machine.
+	cmdline := fmt.Sprintf("console=%s panic=-1", m.console)
+	if c.Append != "" {
+		cmdline += " " + c.Append
+	}
+
+	args := append([]string{}, m.args...)
+	if c.KVM {
+		args = append(args, "-enable-kvm", "-cpu", "host")
+	}
+	args = append(args,
+		"-m", memory,
+		"-nographic",
+		"-no-reboot",
+		"-kernel", c.Kernel,
+		"-initrd", c.Initrd,
+		"-append", cmdline,
+	)
+	if c.DebugExitPort != 0 {
+		args = append(args, "-device", fmt.Sprintf("isa-debug-exit,iobase=0x%x,iosize=0x04", c.DebugExitPort))
+	}
+	if c.Network {
+		nic := m.nic
+		if nic == "" {
+			nic = "virtio-net-pci"
+		}
+		args = append(args, "-nic", "user,model="+nic)
+	}
+	virtiofs := 0
+	for _, s := range c.Shares {
+		if s.Tag == "" {
+			return "", nil, errors.New("missing tag of share")
+		}
+		if s.Socket == "" {
+			fsdev := fmt.Sprintf("local,path=%s,mount_tag=%s,security_model=none",
+				escapeOption(s.Path), escapeOption(s.Tag))
+			if s.ReadOnly {
+				fsdev += ",readonly=on"
+			}
+			args = append(args, "-virtfs", fsdev)
+			continue
+		}
+		args = append(args,
+			"-chardev", fmt.Sprintf("socket,id=virtiofs%d,path=%s", virtiofs, escapeOption(s.Socket)),
+			"-device", fmt.Sprintf("vhost-user-fs-pci,queue-size=1024,chardev=virtiofs%d,tag=%s",
+				virtiofs, escapeOption(s.Tag)),
+		)
+		virtiofs++
+	}
+	if virtiofs > 0 {
+		// vhost-user devices require the memory of the guest to be shared with virtiofsd.
+		args = append(args,
+			"-object", fmt.Sprintf("memory-backend-memfd,id=mem,size=%s,share=on", memory),
+			"-numa", "node,memdev=mem",
+		)
+	}
+	for _, disk := range c.Disks {
+		args = append(args, "-drive", fmt.Sprintf("file=%s,format=raw,if=virtio", escapeOption(disk)))
+	}
+	args = append(args, c.Args...)
+	return binary, args, nil
+}
+
+// escapeOption escapes the value of an option of QEMU, so commas in it do not start the next
+// option.
+func escapeOption(value string) string {
+	return strings.ReplaceAll(value, ",", ",,")
+}
+
+// Run boots the virtual machine and writes its console output to stdout and the diagnostics of
+// QEMU to stderr. Once the virtual machine stopped, it returns the result that bluebox-init
+// reported for the embedded executables, i.e. 0 if all of them passed. An error is returned, if
+// QEMU could not be run or if the guest did not report a result.
+func Run(ctx context.Context, c Config, stdout, stderr io.Writer) (int, error) {
+	binary, args, err := c.Command()
+	if err != nil {
+		return 0, err
+	}
+
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stderr = stderr
+	console, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start %s: %v", binary, err)
+	}
+
+	result, found, scanErr := scan(console, stdout)
+
+	err = cmd.Wait()
+	if scanErr != nil {
+		return 0, fmt.Errorf("failed to read console: %v", scanErr)
+	}
+	if found {
+		return result.Exit, nil
+	}
+
+	// Without the result on the console, fall back to the isa-debug-exit device.
+	var exitErr *exec.ExitError
+	if c.DebugExitPort != 0 && errors.As(err, &exitErr) && exitErr.ExitCode()&1 == 1 {
+		return exitErr.ExitCode() >> 1, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", binary, err)
+	}
+	return 0, errors.New("guest did not report a result")
+}
+
+// scan copies the console output from r to w and looks for the result of bluebox-init.
+func scan(r io.Reader, w io.Writer) (initramfs.Result, bool, error) {
+	var result initramfs.Result
+	found := false
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) != 0 {
+			if _, werr := io.WriteString(w, line); werr != nil {
+				// The console is still scanned for the result.
+				w = io.Discard
+			}
+			if r, ok := initramfs.ParseResult(strings.TrimRight(line, "\r\n")); ok {
+				result, found = r, true
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return result, found, nil
+		}
+		if err != nil {
+			Drain(r)
+			return result, found, err
+		}
+	}
+}
+
+// Drain reads the console output from r until its end. Readers of the console, that stop early,
+// need to drain it, so QEMU does not block on a full pipe.
+func Drain(r io.Reader) {
+	io.Copy(io.Discard, r)
+}
@@ -0,0 +1,222 @@
+package qemu
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestMain allows the test binary to act as fake QEMU executable.
+func TestMain(m *testing.M) {
+	if console, ok := os.LookupEnv("BLUEBOX_FAKE_QEMU_CONSOLE"); ok {
+		fmt.Print(strings.Join(os.Args[1:], " ") + "\n")
+		fmt.Print(console)
+		code, _ := strconv.Atoi(os.Getenv("BLUEBOX_FAKE_QEMU_EXIT"))
+		os.Exit(code)
+	}
+	os.Exit(m.Run())
+}
+
+func TestCommand(t *testing.T) {
+	tests := map[string]struct {
+		config Config
+		binary string
+		args   []string
+		err    bool
+	}{
+		"arm64": {
+			config: Config{Arch: "arm64", Kernel: "vmlinuz", Initrd: "initramfs.cpio", Append: "quiet"},
+			binary: "qemu-system-aarch64",
+			args: []string{
+				"-M", "virt", "-cpu", "cortex-a72", "-m", "2G", "-nographic", "-no-reboot",
+				"-kernel", "vmlinuz", "-initrd", "initramfs.cpio", "-append", "console=ttyAMA0 panic=-1 quiet",
+			},
+		},
+		"amd64 with debug exit": {
+			config: Config{
+				Arch: "amd64", Kernel: "bzImage", Initrd: "initramfs.cpio", Memory: "4G",
+				DebugExitPort: 0xf4, Args: []string{"-smp", "2"},
+			},
+			binary: "qemu-system-x86_64",
+			args: []string{
+				"-m", "4G", "-nographic", "-no-reboot", "-kernel", "bzImage", "-initrd", "initramfs.cpio",
+				"-append", "console=ttyS0 panic=-1", "-device", "isa-debug-exit,iobase=0xf4,iosize=0x04",
+				"-smp", "2",
+			},
+		},
+		"s390x with network": {
+			config: Config{Arch: "s390x", Kernel: "bzImage", Initrd: "initramfs.cpio", Network: true},
+			binary: "qemu-system-s390x",
+			args: []string{
+				"-m", "2G", "-nographic", "-no-reboot", "-kernel", "bzImage", "-initrd", "initramfs.cpio",
+				"-append", "console=ttysclp0 panic=-1", "-nic", "user,model=virtio-net-ccw",
+			},
+		},
+		"amd64 with shares": {
+			config: Config{
+				Arch: "amd64", Kernel: "bzImage", Initrd: "initramfs.cpio", Memory: "1G",
+				Shares: []Share{
+					{Tag: "testdata", Path: "/srv/testdata", ReadOnly: true},
+					{Tag: "results", Socket: "/tmp/virtiofsd.sock"},
+				},
+			},
+			binary: "qemu-system-x86_64",
+			args: []string{
+				"-m", "1G", "-nographic", "-no-reboot", "-kernel", "bzImage", "-initrd", "initramfs.cpio",
+				"-append", "console=ttyS0 panic=-1",
+				"-virtfs", "local,path=/srv/testdata,mount_tag=testdata,security_model=none,readonly=on",
+				"-chardev", "socket,id=virtiofs0,path=/tmp/virtiofsd.sock",
+				"-device", "vhost-user-fs-pci,queue-size=1024,chardev=virtiofs0,tag=results",
+				"-object", "memory-backend-memfd,id=mem,size=1G,share=on", "-numa", "node,memdev=mem",
+			},
+		},
+		"amd64 with commas in shares": {
+			config: Config{
+				Arch: "amd64", Kernel: "bzImage", Initrd: "initramfs.cpio",
+				Shares: []Share{
+					{Tag: "a,b", Path: "/srv/a,b"},
+					{Tag: "c,readonly=on", Socket: "/tmp/c,d.sock"},
+				},
+			},
+			binary: "qemu-system-x86_64",
+			args: []string{
+				"-m", "2G", "-nographic", "-no-reboot", "-kernel", "bzImage", "-initrd", "initramfs.cpio",
+				"-append", "console=ttyS0 panic=-1",
+				"-virtfs", "local,path=/srv/a,,b,mount_tag=a,,b,security_model=none",
+				"-chardev", "socket,id=virtiofs0,path=/tmp/c,,d.sock",
+				"-device", "vhost-user-fs-pci,queue-size=1024,chardev=virtiofs0,tag=c,,readonly=on",
+				"-object", "memory-backend-memfd,id=mem,size=2G,share=on", "-numa", "node,memdev=mem",
+			},
+		},
+		"riscv64 with disks": {
+			config: Config{
+				Arch: "riscv64", Kernel: "Image", Initrd: "initramfs.cpio",
+				Disks: []string{"artifacts.img", "a,b.img"},
+			},
+			binary: "qemu-system-riscv64",
+			args: []string{
+				"-M", "virt", "-m", "2G", "-nographic", "-no-reboot", "-kernel", "Image",
+				"-initrd", "initramfs.cpio", "-append", "console=ttyS0 panic=-1",
+				"-drive", "file=artifacts.img,format=raw,if=virtio",
+				"-drive", "file=a,,b.img,format=raw,if=virtio",
+			},
+		},
+		"unsupported architecture": {
+			config: Config{Arch: "wasm", Kernel: "vmlinuz", Initrd: "initramfs.cpio"},
+			err:    true,
+		},
+		"debug exit on arm64": {
+			config: Config{Arch: "arm64", Kernel: "vmlinuz", Initrd: "initramfs.cpio", DebugExitPort: 0xf4},
+			err:    true,
+		},
+		"no kernel": {
+			config: Config{Arch: "amd64", Initrd: "initramfs.cpio"},
+			err:    true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			binary, args, err := tc.config.Command()
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if binary != tc.binary {
+				t.Fatalf("expected %s but got %s", tc.binary, binary)
+			}
+			if !reflect.DeepEqual(args, tc.args) {
+				t.Fatalf("arguments did not match. Got: %#v\nExpected: %#v", args, tc.args)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := map[string]struct {
+		console   string
+		exit      int
+		debugExit uint16
+		result    int
+		err       bool
+	}{
+		"passed": {
+			console: "[            ] bluebox-result: steps=1 passed=1 failed=0 exit=0\r\n",
+			result:  0,
+		},
+		"failed": {
+			console: "[            ] stdout: FAIL\r\n[            ] bluebox-result: steps=2 passed=1 failed=1 exit=1\r\n",
+			result:  1,
+		},
+		"spoofed by stdout": {
+			console: "[            ] bluebox-result: steps=1 passed=1 failed=0 exit=0\r\n" +
+				"[            ] stdout: [            ] bluebox-result: steps=1 passed=1 failed=0 exit=0\r\n" +
+				"[            ] bluebox-result: steps=2 passed=1 failed=1 exit=1\r\n" +
+				"[            ] stdout: [            ] bluebox-result: steps=2 passed=2 failed=0 exit=0\r\n",
+			result: 1,
+		},
+		"failed with debug exit": {
+			console:   "[            ] bluebox-result: steps=2 passed=1 failed=1 exit=1\r\n",
+			exit:      3,
+			debugExit: 0xf4,
+			result:    1,
+		},
+		"debug exit without console": {
+			exit:      1,
+			debugExit: 0xf4,
+			result:    0,
+		},
+		"kernel panic": {
+			console: "Kernel panic - not syncing: Attempted to kill init!\r\n",
+			err:     true,
+		},
+		"qemu failed": {
+			exit: 1,
+			err:  true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("BLUEBOX_FAKE_QEMU_CONSOLE", tc.console)
+			t.Setenv("BLUEBOX_FAKE_QEMU_EXIT", strconv.Itoa(tc.exit))
+
+			config := Config{
+				Arch:          "amd64",
+				Kernel:        "bzImage",
+				Initrd:        "initramfs.cpio",
+				Binary:        os.Args[0],
+				DebugExitPort: tc.debugExit,
+			}
+
+			var stdout bytes.Buffer
+			result, err := Run(context.Background(), config, &stdout, io.Discard)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != tc.result {
+				t.Fatalf("expected result %d but got %d", tc.result, result)
+			}
+			if !strings.HasSuffix(stdout.String(), tc.console) {
+				t.Fatalf("console output was not forwarded: %q", stdout.String())
+			}
+		})
+	}
+}
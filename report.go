@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/florianl/bluebox/report"
+)
+
+// reportCommand converts the console output of bluebox-init into JUnit XML and TAP reports.
+func reportCommand(args []string) error {
+	var junit, tap string
+
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "report converts the console output of bluebox-init, read from the "+
+			"given file or stdin,\ninto test reports. Without -junit and -tap, TAP is written to stdout.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&junit, "junit", "", "Write a JUnit XML report to the given file. Use - for stdout.")
+	fs.StringVar(&tap, "tap", "", "Write a TAP version 13 report to the given file. Use - for stdout.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("expected at most one console log but got %d", fs.NArg())
+	}
+	if junit == "" && tap == "" {
+		tap = "-"
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.NArg() == 1 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	r, err := report.Parse(in)
+	if err != nil {
+		return fmt.Errorf("failed to parse console output: %v", err)
+	}
+
+	if junit != "" {
+		if err := writeReport(junit, r.WriteJUnit); err != nil {
+			return err
+		}
+	}
+	if tap != "" {
+		if err := writeReport(tap, r.WriteTAP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeReport calls write with the file name or stdout, if name is -.
+func writeReport(name string, write func(io.Writer) error) error {
+	if name == "-" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return f.Close()
+}
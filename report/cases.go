@@ -0,0 +1,166 @@
+package report
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseCases returns the test cases found in the output lines of an executable. The formats of
+// go test -json, go test -v and TAP are tried in this order.
+func parseCases(lines []string) []*Case {
+	if cases := parseTest2JSON(lines); len(cases) != 0 {
+		return cases
+	}
+	if cases := parseGoTest(lines); len(cases) != 0 {
+		return cases
+	}
+	return parseTAP(lines)
+}
+
+// test2json is a single event of go test -json, see go doc cmd/test2json.
+type test2json struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+// parseTest2JSON returns the test cases of go test -json output.
+func parseTest2JSON(lines []string) []*Case {
+	var cases []*Case
+	output := make(map[string][]string)
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		var e test2json
+		if err := json.Unmarshal([]byte(line), &e); err != nil || e.Action == "" || e.Test == "" {
+			continue
+		}
+		status := Passed
+		switch e.Action {
+		case "output":
+			output[e.Test] = append(output[e.Test], strings.TrimSuffix(e.Output, "\n"))
+			continue
+		case "pass":
+		case "fail":
+			status = Failed
+		case "skip":
+			status = Skipped
+		default:
+			continue
+		}
+		cases = append(cases, &Case{
+			Name:     e.Test,
+			Status:   status,
+			Duration: seconds(e.Elapsed),
+			Output:   output[e.Test],
+		})
+	}
+	return cases
+}
+
+var (
+	// goTestRun matches the start of a test in go test -v output.
+	goTestRun = regexp.MustCompile(`^=== (?:RUN|CONT|PAUSE|NAME)\s+(\S+)`)
+	// goTestResult matches the result of a test in go test -v output.
+	goTestResult = regexp.MustCompile(`^\s*--- (PASS|FAIL|SKIP): (\S+) \(([0-9.]+)s\)`)
+)
+
+// parseGoTest returns the test cases of go test -v output. Output lines are assigned to the test
+// that was started or continued last.
+func parseGoTest(lines []string) []*Case {
+	var cases []*Case
+	var running string
+	output := make(map[string][]string)
+	for _, line := range lines {
+		if m := goTestRun.FindStringSubmatch(line); m != nil {
+			running = m[1]
+			continue
+		}
+		m := goTestResult.FindStringSubmatch(line)
+		if m == nil {
+			if running != "" {
+				output[running] = append(output[running], line)
+			}
+			continue
+		}
+
+		c := &Case{Name: m[2], Output: output[m[2]]}
+		switch m[1] {
+		case "FAIL":
+			c.Status = Failed
+		case "SKIP":
+			c.Status = Skipped
+		}
+		if elapsed, err := strconv.ParseFloat(m[3], 64); err == nil {
+			c.Duration = seconds(elapsed)
+		}
+		cases = append(cases, c)
+	}
+	return cases
+}
+
+var (
+	// tapResult matches a test line of TAP. Nested test lines of subtests are indented or, like
+	// in kselftest, prefixed with "# " and are not matched.
+	tapResult = regexp.MustCompile(`^(not )?ok\b\s*(\d+)?\s*(?:- )?(.*?)\s*(?:#\s*((?i:SKIP|TODO))\S*\s*(.*))?$`)
+	// tapHeader matches the version or the plan of TAP output.
+	tapHeader = regexp.MustCompile(`^(?:TAP version \d+|1\.\.\d+)\b`)
+)
+
+// parseTAP returns the test cases of TAP output. Lines, that are not test lines, are assigned to
+// the following test case. Without the version or the plan of TAP, only test lines with a test
+// number are accepted, so output like a plain "ok" is not mistaken for a test case.
+func parseTAP(lines []string) []*Case {
+	header := false
+	for _, line := range lines {
+		if tapHeader.MatchString(line) {
+			header = true
+			break
+		}
+	}
+
+	var cases []*Case
+	var output []string
+	for _, line := range lines {
+		m := tapResult.FindStringSubmatch(line)
+		if m == nil || (!header && m[2] == "") {
+			output = append(output, line)
+			continue
+		}
+
+		c := &Case{Name: m[3], Output: output}
+		if c.Name == "" {
+			// Test numbers are optional and then count up from 1.
+			number := m[2]
+			if number == "" {
+				number = strconv.Itoa(len(cases) + 1)
+			}
+			c.Name = "test " + number
+		}
+		output = nil
+		switch {
+		case strings.EqualFold(m[4], "SKIP"):
+			c.Status = Skipped
+			c.Message = m[5]
+		case strings.EqualFold(m[4], "TODO"):
+			// Failures of TODO tests are expected and not reported as failure.
+			c.Status = Skipped
+			c.Message = "TODO " + m[5]
+		case m[1] != "":
+			c.Status = Failed
+		}
+		cases = append(cases, c)
+	}
+	return cases
+}
+
+// seconds converts the elapsed time in seconds to a time.Duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
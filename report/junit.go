@@ -0,0 +1,131 @@
+package report
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// junitSuites is the root element of a JUnit XML report.
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	ID        int         `xml:"id,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Errors    int         `xml:"errors,attr"`
+	Skipped   int         `xml:"skipped,attr"`
+	Time      string      `xml:"time,attr"`
+	Cases     []junitCase `xml:"testcase"`
+	SystemOut *junitText  `xml:"system-out"`
+	SystemErr *junitText  `xml:"system-err"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut *junitText    `xml:"system-out"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr,omitempty"`
+	Content string `xml:",cdata"`
+}
+
+// junitText holds output, that is written as CDATA to keep it readable.
+type junitText struct {
+	Content string `xml:",cdata"`
+}
+
+// junitTime formats d in seconds as expected by JUnit XML.
+func junitTime(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// joinLines returns lines as text with a trailing newline. Characters, that are not allowed in
+// XML, like the escape sequences of colored output, are dropped.
+func joinLines(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' || (r >= 0x20 && r != 0xfffe && r != 0xffff) {
+			return r
+		}
+		return -1
+	}, strings.Join(lines, "\n")+"\n")
+}
+
+// text returns lines as junitText or nil, if there are no lines.
+func text(lines []string) *junitText {
+	if len(lines) == 0 {
+		return nil
+	}
+	return &junitText{Content: joinLines(lines)}
+}
+
+// WriteJUnit writes the report as JUnit XML to w. Every step is written as testsuite.
+func (r *Report) WriteJUnit(w io.Writer) error {
+	root := junitSuites{
+		Failures: r.Count(Failed),
+		Skipped:  r.Count(Skipped),
+	}
+	var total time.Duration
+	for _, s := range r.Suites {
+		suite := junitSuite{
+			Name:      s.Name,
+			ID:        s.Step,
+			Tests:     len(s.Cases),
+			Failures:  s.Count(Failed),
+			Skipped:   s.Count(Skipped),
+			Time:      junitTime(s.Duration),
+			SystemOut: text(s.Stdout),
+			SystemErr: text(s.Stderr),
+		}
+		for _, c := range s.Cases {
+			jc := junitCase{
+				Name:      c.Name,
+				Classname: s.Name,
+				Time:      junitTime(c.Duration),
+			}
+			switch c.Status {
+			case Failed:
+				jc.Failure = &junitMessage{Message: c.Message, Content: joinLines(c.Output)}
+			case Skipped:
+				jc.Skipped = &junitMessage{Message: c.Message}
+				jc.SystemOut = text(c.Output)
+			default:
+				jc.SystemOut = text(c.Output)
+			}
+			suite.Cases = append(suite.Cases, jc)
+		}
+		root.Tests += suite.Tests
+		total += s.Duration
+		root.Suites = append(root.Suites, suite)
+	}
+	root.Time = junitTime(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(root); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,234 @@
+// Package report turns the console output of bluebox-init into test reports.
+//
+// The console output is split into the steps, i.e. the executables that were run by bluebox-init.
+// Both the human readable output and the structured output, that is enabled with SetEventStream of
+// github.com/florianl/bluebox/initramfs, are supported. The output of every step is searched for
+// test cases in the formats of go test -v, go test -json (test2json) and TAP, as it is printed by
+// kselftest. Steps without recognized test cases are reported as single test case. The resulting
+// report can be written as JUnit XML and TAP version 13.
+package report
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/florianl/bluebox/event"
+)
+
+// Status is the result of a test case.
+type Status int
+
+const (
+	// Passed is the status of a successful test case.
+	Passed Status = iota
+	// Failed is the status of a failed test case.
+	Failed
+	// Skipped is the status of a test case that was not run.
+	Skipped
+)
+
+func (s Status) String() string {
+	switch s {
+	case Passed:
+		return "pass"
+	case Failed:
+		return "fail"
+	case Skipped:
+		return "skip"
+	}
+	return "unknown"
+}
+
+// Case is a single test case.
+type Case struct {
+	// Name of the test case, e.g. TestFoo/bar.
+	Name string
+	// Status is the result of the test case.
+	Status Status
+	// Duration is the run time of the test case, if known.
+	Duration time.Duration
+	// Message explains why a test case failed or was skipped.
+	Message string
+	// Output holds the lines, that belong to the test case.
+	Output []string
+}
+
+// Suite holds the test cases of a single step of bluebox-init.
+type Suite struct {
+	// Step is the number of the executable, starting at 1.
+	Step int
+	// Name of the executable inside the archive.
+	Name string
+	// Duration is the run time of the executable, if known.
+	Duration time.Duration
+	// Cases holds the test cases of the executable in the order they finished.
+	Cases []*Case
+	// Stdout holds the lines the executable wrote to stdout.
+	Stdout []string
+	// Stderr holds the lines the executable wrote to stderr.
+	Stderr []string
+}
+
+// Count returns the number of test cases with status s.
+func (s *Suite) Count(status Status) int {
+	n := 0
+	for _, c := range s.Cases {
+		if c.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// Report holds the test suites of all steps.
+type Report struct {
+	// Suites holds a test suite for every step in the order they were run.
+	Suites []*Suite
+}
+
+// Count returns the number of test cases with status s in all test suites.
+func (r *Report) Count(status Status) int {
+	n := 0
+	for _, s := range r.Suites {
+		n += s.Count(status)
+	}
+	return n
+}
+
+// Parse reads the console output of bluebox-init from r and returns the report for all steps.
+// Structured output is used, if r holds events. Otherwise the human readable output is parsed.
+func Parse(r io.Reader) (*Report, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	steps, _, err := event.Collect(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		steps = parseConsole(data)
+	}
+	return FromSteps(steps), nil
+}
+
+// FromSteps returns the report for the steps reconstructed by Collect of the package
+// github.com/florianl/bluebox/event.
+func FromSteps(steps []*event.Step) *Report {
+	r := &Report{}
+	for _, step := range steps {
+		s := &Suite{
+			Step:     step.Step,
+			Name:     step.Name,
+			Duration: step.Duration,
+			Stdout:   step.Stdout,
+			Stderr:   step.Stderr,
+		}
+		if step.Skipped {
+			s.Cases = []*Case{{Name: path.Base(step.Name), Status: Skipped, Message: "not run"}}
+			r.Suites = append(r.Suites, s)
+			continue
+		}
+		s.Cases = parseCases(step.Stdout)
+		if len(s.Cases) == 0 {
+			s.Cases = parseCases(step.Stderr)
+		}
+		if !step.Passed() && s.Count(Failed) == 0 {
+			// Report the failure of the step itself, e.g. a crash after the last test case.
+			s.Cases = append(s.Cases, &Case{
+				Name:     path.Base(step.Name),
+				Status:   Failed,
+				Duration: step.Duration,
+				Message:  failure(step),
+				Output:   append(append([]string{}, step.Stdout...), step.Stderr...),
+			})
+		} else if len(s.Cases) == 0 {
+			s.Cases = append(s.Cases, &Case{
+				Name:     path.Base(step.Name),
+				Duration: step.Duration,
+				Output:   append(append([]string{}, step.Stdout...), step.Stderr...),
+			})
+		}
+		r.Suites = append(r.Suites, s)
+	}
+	return r
+}
+
+// failure describes why step did not pass.
+func failure(step *event.Step) string {
+	switch {
+	case step.TimedOut:
+		return "timed out"
+	case step.Error != "":
+		return step.Error
+	case !step.Exited:
+		return "did not exit"
+	case step.Signal != "":
+		return "terminated by signal " + step.Signal
+	}
+	return "exit status " + strconv.Itoa(step.Status)
+}
+
+// Prefixes of the human readable output of bluebox-init.
+const (
+	infoPrefix   = "[            ]\t"
+	stdoutPrefix = "[            ] stdout: "
+	stderrPrefix = "[            ] stderr: "
+)
+
+// parseConsole reconstructs the steps from the human readable console output of bluebox-init.
+// A step starts with the line, that holds the path of the executable, and ends with the start of
+// the next step, as the output of an executable might be printed after its exit status.
+func parseConsole(data []byte) []*event.Step {
+	var steps []*event.Step
+	var current *event.Step
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		if line, ok := strings.CutPrefix(line, stdoutPrefix); ok && current != nil {
+			current.Stdout = append(current.Stdout, line)
+			continue
+		}
+		if line, ok := strings.CutPrefix(line, stderrPrefix); ok && current != nil {
+			current.Stderr = append(current.Stderr, line)
+			continue
+		}
+		if name, ok := strings.CutPrefix(line, infoPrefix+"Skipping ./"); ok {
+			current = &event.Step{Step: len(steps) + 1, Name: name, Skipped: true}
+			steps = append(steps, current)
+			continue
+		}
+		info, ok := strings.CutPrefix(line, infoPrefix+"./")
+		if !ok {
+			continue
+		}
+		if current != nil {
+			if rest, ok := strings.CutPrefix(info, current.Name+" exited, exit status "); ok {
+				current.Exited = true
+				current.Status, _ = strconv.Atoi(rest)
+				continue
+			}
+			if strings.HasPrefix(info, current.Name+" timed out after ") {
+				current.TimedOut = true
+				continue
+			}
+		}
+
+		// The executable is printed with its arguments separated by ", ".
+		name, args, _ := strings.Cut(info, " ")
+		current = &event.Step{Step: len(steps) + 1, Name: name}
+		if args != "" {
+			current.Args = strings.Split(args, ", ")
+		}
+		steps = append(steps, current)
+	}
+	return steps
+}
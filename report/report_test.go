@@ -0,0 +1,189 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/florianl/bluebox/event"
+)
+
+// console is the human readable output of bluebox-init for five steps, of which the last one
+// was skipped.
+var console = strings.Join([]string{
+	"[    0.000000] Linux version 6.1.0",
+	"[            ]\t./pkg.test -test.v",
+	"[            ] stdout: === RUN   TestFoo",
+	"[            ] stdout: --- PASS: TestFoo (0.01s)",
+	"[            ] stdout: === RUN   TestBar",
+	"[            ] stdout:     bar_test.go:12: unexpected value",
+	"[            ]\t./pkg.test exited, exit status 1",
+	"[            ] stdout: --- FAIL: TestBar (1.50s)",
+	"[            ] stdout: === RUN   TestSkip",
+	"[            ] stdout: --- SKIP: TestSkip (0.00s)",
+	"[            ] stdout: FAIL",
+	"[            ]\t./kselftest ",
+	"[            ] stdout: TAP version 13",
+	"[            ] stdout: 1..3",
+	"[            ] stdout: ok   1 - test_xdp.o (2 programs, 1 maps)",
+	"[            ] stdout: # verifier log",
+	"[            ] stdout: not ok   2 - test_tc.o: load failed",
+	"[            ] stdout: ok   3 - test_lsm.o # SKIP requires BTF",
+	"[            ]\t./kselftest exited, exit status 1",
+	"[            ]\t./date +%s",
+	"[            ] stdout: 1700000000",
+	"[            ]\t./date exited, exit status 0",
+	"[            ]\t./check ",
+	"[            ] stdout: ok",
+	"[            ]\t./check exited, exit status 0",
+	"[            ]\tDeadline of 1m0s expired, skipping remaining executables",
+	"[            ]\tSkipping ./pkg/late.test",
+	"[            ] bluebox-result: steps=5 passed=2 failed=3 exit=1",
+}, "\n")
+
+func TestParseConsole(t *testing.T) {
+	r, err := Parse(strings.NewReader(console))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Suites) != 5 {
+		t.Fatalf("expected 5 suites but got %d", len(r.Suites))
+	}
+
+	type summary struct {
+		name    string
+		status  Status
+		message string
+	}
+	expected := [][]summary{
+		{{"TestFoo", Passed, ""}, {"TestBar", Failed, ""}, {"TestSkip", Skipped, ""}},
+		{{"test_xdp.o (2 programs, 1 maps)", Passed, ""}, {"test_tc.o: load failed", Failed, ""}, {"test_lsm.o", Skipped, "requires BTF"}},
+		{{"date", Passed, ""}},
+		{{"check", Passed, ""}},
+		{{"late.test", Skipped, "not run"}},
+	}
+	for i, s := range r.Suites {
+		var got []summary
+		for _, c := range s.Cases {
+			got = append(got, summary{c.Name, c.Status, c.Message})
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expected[i]) {
+			t.Fatalf("unexpected cases of %s: %v", s.Name, got)
+		}
+	}
+	bar := r.Suites[0].Cases[1]
+	if bar.Duration != 1500*time.Millisecond || len(bar.Output) != 1 {
+		t.Fatalf("unexpected test case %#v", bar)
+	}
+	if r.Suites[2].Name != "date" || r.Suites[2].Stdout[0] != "1700000000" {
+		t.Fatalf("unexpected suite %#v", r.Suites[2])
+	}
+
+	var junit bytes.Buffer
+	if err := r.WriteJUnit(&junit); err != nil {
+		t.Fatal(err)
+	}
+	var root junitSuites
+	if err := xml.Unmarshal(junit.Bytes(), &root); err != nil {
+		t.Fatal(err)
+	}
+	if root.Tests != 9 || root.Failures != 2 || root.Skipped != 3 {
+		t.Fatalf("unexpected JUnit totals %d %d %d", root.Tests, root.Failures, root.Skipped)
+	}
+
+	var tap bytes.Buffer
+	if err := r.WriteTAP(&tap); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"TAP version 13\n1..9\n",
+		"ok 1 - pkg.test: TestFoo\n",
+		"not ok 2 - pkg.test: TestBar\n  ---\n  duration_ms: 1500\n  output: |\n        bar_test.go:12: unexpected value\n  ...\n",
+		"ok 6 - kselftest: test_lsm.o # SKIP requires BTF\n",
+		"ok 7 - date: date\n",
+		"ok 8 - check: check\n",
+		"ok 9 - pkg/late.test: late.test # SKIP not run\n",
+	} {
+		if !strings.Contains(tap.String(), line) {
+			t.Fatalf("expected %q in TAP output:\n%s", line, tap.String())
+		}
+	}
+}
+
+func TestParseEvents(t *testing.T) {
+	one := 1
+	var lines []string
+	for i, e := range []event.Event{
+		{Type: event.StepStarted, Step: 1, Name: "pkg.test", Args: []string{"-test.v"}},
+		{Type: event.StdoutLine, Step: 1, Line: `{"Action":"run","Test":"TestFoo"}`},
+		{Type: event.StdoutLine, Step: 1, Line: `{"Action":"output","Test":"TestFoo","Output":"boom\n"}`},
+		{Type: event.StdoutLine, Step: 1, Line: `{"Action":"fail","Test":"TestFoo","Elapsed":0.5}`},
+		{Type: event.StepExited, Step: 1, Name: "pkg.test", Status: &one},
+		{Type: event.StepStarted, Step: 2, Name: "hang"},
+		{Type: event.StepExited, Step: 2, Name: "hang", Status: &one, Signal: "killed", TimedOut: true},
+		{Type: event.StepSkipped, Step: 3, Name: "late.test"},
+	} {
+		e.Seq = i + 1
+		data, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, fmt.Sprintf("@bluebox %08x %s", crc32.ChecksumIEEE(data), data))
+	}
+
+	r, err := Parse(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Suites) != 3 {
+		t.Fatalf("expected 3 suites but got %d", len(r.Suites))
+	}
+	foo := r.Suites[0].Cases[0]
+	if foo.Name != "TestFoo" || foo.Status != Failed || foo.Duration != 500*time.Millisecond ||
+		len(foo.Output) != 1 || foo.Output[0] != "boom" {
+		t.Fatalf("unexpected test case %#v", foo)
+	}
+	hang := r.Suites[1].Cases[0]
+	if hang.Name != "hang" || hang.Status != Failed || hang.Message != "timed out" {
+		t.Fatalf("unexpected test case %#v", hang)
+	}
+	late := r.Suites[2].Cases
+	if len(late) != 1 || late[0].Name != "late.test" || late[0].Status != Skipped {
+		t.Fatalf("unexpected test cases of the skipped step %#v", late)
+	}
+}
+
+func TestParseTAP(t *testing.T) {
+	tests := map[string]struct {
+		lines []string
+		names []string
+	}{
+		"plain ok": {
+			lines: []string{"ok"},
+		},
+		"numbers without plan": {
+			lines: []string{"ok 1", "not ok 2 - bar"},
+			names: []string{"test 1", "bar"},
+		},
+		"plan without numbers": {
+			lines: []string{"1..2", "ok", "not ok - bar"},
+			names: []string{"test 1", "bar"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var names []string
+			for _, c := range parseTAP(tc.lines) {
+				names = append(names, c.Name)
+			}
+			if fmt.Sprint(names) != fmt.Sprint(tc.names) {
+				t.Fatalf("expected test cases %q but got %q", tc.names, names)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package report
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteTAP writes the report as TAP version 13 to w. Every test case is written as test line with
+// the name of its step as prefix. The output of failed test cases is added as YAML block.
+func (r *Report) WriteTAP(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	total := 0
+	for _, s := range r.Suites {
+		total += len(s.Cases)
+	}
+	fmt.Fprintf(bw, "TAP version 13\n1..%d\n", total)
+
+	n := 0
+	for _, s := range r.Suites {
+		for _, c := range s.Cases {
+			n++
+			name := tapEscape(s.Name + ": " + c.Name)
+			switch c.Status {
+			case Passed:
+				fmt.Fprintf(bw, "ok %d - %s\n", n, name)
+			case Skipped:
+				fmt.Fprintf(bw, "ok %d - %s # SKIP %s\n", n, name, tapEscape(c.Message))
+			case Failed:
+				fmt.Fprintf(bw, "not ok %d - %s\n", n, name)
+				fmt.Fprintf(bw, "  ---\n")
+				if c.Message != "" {
+					fmt.Fprintf(bw, "  message: %q\n", c.Message)
+				}
+				if c.Duration > 0 {
+					fmt.Fprintf(bw, "  duration_ms: %d\n", c.Duration.Milliseconds())
+				}
+				if len(c.Output) != 0 {
+					fmt.Fprintf(bw, "  output: |\n")
+					for _, line := range c.Output {
+						fmt.Fprintf(bw, "    %s\n", line)
+					}
+				}
+				fmt.Fprintf(bw, "  ...\n")
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// tapEscape escapes the characters of s, that have a meaning in a TAP test line.
+func tapEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "#", `\#`, "\n", " ").Replace(s)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/florianl/bluebox/artifact"
+	"github.com/florianl/bluebox/event"
+	"github.com/florianl/bluebox/qemu"
+)
+
+// runCommand boots a kernel with an archive in QEMU and returns the result of the guest as exit
+// code.
+func runCommand(args []string) error {
+	var config qemu.Config
+	var debugExit uint
+	var artifacts string
+	var artifactsSize int64
+	var coverDir string
+
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "run boots the given kernel with the archive in QEMU and exits with the "+
+			"result of the embedded executables.\nAdditional arguments for QEMU can be passed after --.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&config.Kernel, "k", "", "Kernel image that is booted.")
+	fs.StringVar(&config.Initrd, "i", "initramfs.cpio", "Archive that is used as initial ramdisk.")
+	fs.StringVar(&config.Arch, "a", "", "Architecture of the kernel and the archive. All values "+
+		"that are accepted by GOARCH are possible.\nBy default the host architecture is used.")
+	fs.StringVar(&config.Memory, "m", "2G", "Memory of the virtual machine.")
+	fs.StringVar(&config.Append, "append", "", "Additional parameters for the kernel command line.")
+	fs.StringVar(&config.Binary, "qemu", "", "QEMU executable. By default qemu-system-* for the "+
+		"architecture is used.")
+	fs.BoolVar(&config.KVM, "kvm", false, "Enable hardware acceleration with KVM.")
+	fs.UintVar(&debugExit, "debug-exit", 0, "Add the isa-debug-exit device at the given I/O port. "+
+		"Needs to match the port the archive was created with.")
+	fs.BoolVar(&config.Network, "nic", false, "Add a virtio-net device with user mode networking. "+
+		"Create the archive with\n-net eth0=10.0.2.15/24 -route \"default via 10.0.2.2\" to use it.")
+	fs.Func("share", "Share a host directory with 9p. Argument can be specified multiple times.\n\n"+
+		"Format:\ntestdata=/srv/testdata\t\tShare /srv/testdata with the tag testdata.\n"+
+		"testdata=/srv/testdata:ro\tShare /srv/testdata read-only.", func(arg string) error {
+		tag, path, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("invalid share '%s'", arg)
+		}
+		path, readOnly := strings.CutSuffix(path, ":ro")
+		config.Shares = append(config.Shares, qemu.Share{Tag: tag, Path: path, ReadOnly: readOnly})
+		return nil
+	})
+	fs.Func("virtiofs", "Share a host directory with virtiofs through the socket of a running "+
+		"virtiofsd.\nArgument can be specified multiple times.\n\nFormat:\n"+
+		"results=/tmp/virtiofsd.sock\tUse the socket with the tag results.", func(arg string) error {
+		tag, socket, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("invalid virtiofs share '%s'", arg)
+		}
+		config.Shares = append(config.Shares, qemu.Share{Tag: tag, Socket: socket})
+		return nil
+	})
+	fs.StringVar(&artifacts, "artifacts", "", "Add a raw disk as first virtio block device and "+
+		"extract the files, that the guest wrote to it,\ninto the given directory. Create the "+
+		"archive with -artifacts to write them.")
+	fs.Int64Var(&artifactsSize, "artifacts-size", artifact.DefaultSize, "Size of the disk for "+
+		"-artifacts in bytes.")
+	fs.StringVar(&coverDir, "coverdir", "", "Extract the coverage data, that the guest wrote to "+
+		"the console, into the given directory.\nCreate the archive with -cover to write it. "+
+		"The files can be processed with go tool covdata.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if debugExit > math.MaxUint16 {
+		return fmt.Errorf("invalid I/O port 0x%x for isa-debug-exit", debugExit)
+	}
+	config.DebugExitPort = uint16(debugExit)
+	config.Args = fs.Args()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var disk string
+	if artifacts != "" {
+		tmpDir, err := os.MkdirTemp("", "bluebox-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+		disk = filepath.Join(tmpDir, "artifacts.img")
+		if err := artifact.CreateDisk(disk, artifactsSize); err != nil {
+			return err
+		}
+		// The disk is added first, so it is /dev/vda in the guest.
+		config.Disks = append([]string{disk}, config.Disks...)
+	}
+
+	var stdout io.Writer = os.Stdout
+	var console *io.PipeWriter
+	var coverFiles []string
+	var coverErr error
+	coverDone := make(chan struct{})
+	if coverDir != "" {
+		// The console is decoded while the guest runs, so the coverage data is not buffered.
+		var pr *io.PipeReader
+		pr, console = io.Pipe()
+		stdout = io.MultiWriter(os.Stdout, console)
+		go func() {
+			defer close(coverDone)
+			coverFiles, coverErr = event.ExtractFiles(pr, coverDir)
+			qemu.Drain(pr)
+		}()
+	}
+
+	result, err := qemu.Run(ctx, config, stdout, os.Stderr)
+	if console != nil {
+		console.Close()
+		<-coverDone
+	}
+	if err != nil {
+		return err
+	}
+	if console != nil {
+		if coverErr != nil {
+			return coverErr
+		}
+		fmt.Fprintf(os.Stderr, "Extracted %d coverage files to %s\n", len(coverFiles), coverDir)
+	}
+	if disk != "" {
+		files, err := artifact.ExtractFile(disk, artifacts)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Extracted %d artifacts to %s\n", len(files), artifacts)
+	}
+	if result != 0 {
+		return exitCode(result)
+	}
+	return nil
+}